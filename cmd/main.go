@@ -1,29 +1,69 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/arzzon/app-backup-restore/internal/constants"
+	"github.com/arzzon/app-backup-restore/internal/encryption"
 	"github.com/arzzon/app-backup-restore/internal/handlers"
-	"github.com/arzzon/app-backup-restore/internal/utils/fileUtils"
+	"github.com/arzzon/app-backup-restore/internal/storage"
 	"log"
 	"net/http"
+	"time"
+	_ "time/tzdata"
 )
 
-func init() {
+func main() {
+	backend := flag.String("storage", "filesystem", "storage backend, filesystem or s3")
+	storeRoot := flag.String("store-root", constants.STORE_DIR, "root directory of the filesystem storage")
+	var s3Config storage.S3Config
+	flag.StringVar(&s3Config.Endpoint, "s3-endpoint", "", "URL of the S3 API")
+	flag.StringVar(&s3Config.Region, "s3-region", "us-east-1", "region of the S3 bucket")
+	flag.StringVar(&s3Config.Bucket, "s3-bucket", "", "S3 bucket")
+	flag.StringVar(&s3Config.Prefix, "s3-prefix", "", "prefix of the keys in the S3 bucket")
+	flag.BoolVar(&s3Config.PathStyle, "s3-path-style", false, "address the S3 bucket in the path instead of the host name")
+	flag.StringVar(&s3Config.CredentialsFile, "s3-credentials-file", "", "shared credentials file, used when AWS_ACCESS_KEY_ID is not set")
+	flag.StringVar(&s3Config.Profile, "s3-profile", "", "profile of the shared credentials file")
+	retentionInterval := flag.Duration("retention-interval", constants.RETENTION_INTERVAL*time.Second, "interval of the retention garbage collection, 0 to disable it")
+	masterKeyFile := flag.String("master-key-file", "", "file holding the base64 encoded AES-256 master key encrypting the backups")
+	flag.Parse()
+
 	fmt.Println("Initializing application...")
-	// Creating store directory if it does not exist
-	if fileUtils.CreateDir(constants.APPS_DIR) != nil {
-		log.Fatal("Error creating store")
+	var store storage.Storage
+	var err error
+	switch *backend {
+	case "filesystem":
+		// Creating store directory if it does not exist
+		store, err = storage.NewFilesystem(*storeRoot)
+	case "s3":
+		store, err = storage.NewS3(s3Config)
+	default:
+		err = fmt.Errorf("unknown storage backend %s", *backend)
 	}
-	if fileUtils.CreateDir(constants.BACKUPS_DIR) != nil {
-		log.Fatal("Error creating store")
+	if err != nil {
+		log.Fatal("Error creating store: ", err)
 	}
-}
+	handlers.SetStorage(store)
+	if *masterKeyFile != "" {
+		keyring, err := encryption.LoadKeyring(*masterKeyFile)
+		if err != nil {
+			log.Fatal("Error loading master key: ", err)
+		}
+		handlers.SetKeyring(keyring)
+	}
+	if err := handlers.StartScheduler(); err != nil {
+		log.Fatal("Error starting scheduler: ", err)
+	}
+	handlers.StartRetention(*retentionInterval)
 
-func main() {
 	http.HandleFunc("/application/", handlers.ApplicationDataHandler)
 	http.HandleFunc("/backup/", handlers.BackupHandler)
 	http.HandleFunc("/restore/", handlers.RestoreBackupHandler)
+	http.HandleFunc("/tasks/", handlers.TaskHandler)
+	http.HandleFunc("/transform-profile/", handlers.TransformProfileHandler)
+	http.HandleFunc("/encryption/", handlers.EncryptionHandler)
+	http.HandleFunc("/schedule/", handlers.ScheduleHandler)
+	http.HandleFunc("/retention/", handlers.RetentionHandler)
 
 	fmt.Println("Starting server on port 8080...")
 	log.Fatal(http.ListenAndServe(":8080", nil))
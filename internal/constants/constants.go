@@ -1,17 +1,50 @@
 package constants
 
 const (
+	TOOL_VERSION = "v0.1.0"
+
 	// Kubernetes
 	KUBECONFIG_PATH = "~/.kube/config"
 
-	// store
-	//STORE_DIR   = "store"
-	APPS_DIR    = "store/apps"
-	BACKUPS_DIR = "store/backups"
+	// store, the default root of the filesystem storage
+	STORE_DIR = "store"
+	// key prefixes of the stored objects
+	APPS_DIR        = "apps"
+	APP_HISTORY_DIR = "app-history"
+	BACKUPS_DIR     = "backups"
+	// stored restore transform profiles
+	TRANSFORM_PROFILES_DIR = "transform-profiles"
+	// stored backup schedules
+	SCHEDULES_DIR = "schedules"
+
+	// files kept inside a backup directory
+	BACKUP_REPORT_FILE   = "report.json"
+	BACKUP_MANIFEST_FILE = "manifest.json"
+	// directory of the cluster-scoped objects, next to those of each namespace
+	CLUSTER_SCOPED_DIR = "_cluster"
+
+	// tasks (in seconds), finished tasks being forgotten after TASK_EXPIRY
+	TASK_POLL_INTERVAL = 2
+	TASK_TIMEOUT       = 600
+	TASK_EXPIRY        = 86400
+
+	// restore readiness (in seconds)
+	READY_POLL_INTERVAL = 2
+	READY_TIMEOUT       = 300
+
+	// schedules (in seconds), runs later than the grace period count as missed
+	SCHEDULE_POLL_INTERVAL = 5
+	SCHEDULE_MISSED_GRACE  = 60
+
+	// backup hooks, default timeout (in seconds) and output kept of each stream (in bytes)
+	HOOK_TIMEOUT      = 30
+	HOOK_OUTPUT_LIMIT = 64 << 10
+
+	// default interval of the retention garbage collection (in seconds)
+	RETENTION_INTERVAL = 3600
 
-	// tasks
-	//TASK_POLL_INTERVAL = 2
-	//TASK_TIMEOUT       = 60
+	// largest backup archive accepted by an import, compressed or not (in bytes)
+	ARCHIVE_MAX_SIZE = 1 << 30
 
 	// worker pool
 	NUM_BACKUP_WORKERS   = 10
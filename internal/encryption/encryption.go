@@ -0,0 +1,236 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// KeySize is the size of the master and data keys, for AES-256
+const KeySize = 32
+
+// sealedPrefix marks the data sealed by Seal
+var sealedPrefix = []byte("brt-encrypted-v1\n")
+
+var ErrUnknownKey = errors.New("master key not available")
+
+// Keyring holds the master key, read from a file holding it base64 encoded,
+// along with the retired keys still wrapping data keys, kept one per line next
+// to it with the .previous suffix. Master keys are identified by the hash of
+// the key.
+type Keyring struct {
+	mutex     sync.RWMutex
+	path      string
+	currentID string
+	keys      map[string][]byte
+}
+
+// LoadKeyring reads the master key file and the retired keys, if any
+func LoadKeyring(path string) (*Keyring, error) {
+	keys, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) != 1 {
+		return nil, fmt.Errorf("master key %s must hold a single key", path)
+	}
+	current := keys[0]
+	keyring := &Keyring{path: path, currentID: getKeyID(current), keys: map[string][]byte{getKeyID(current): current}}
+	retired, err := readKeyFile(path + ".previous")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, key := range retired {
+		keyring.keys[getKeyID(key)] = key
+	}
+	return keyring, nil
+}
+
+// KeyID returns the ID of the current master key
+func (keyring *Keyring) KeyID() string {
+	keyring.mutex.RLock()
+	defer keyring.mutex.RUnlock()
+	return keyring.currentID
+}
+
+// Wrap encrypts the data key with the current master key and returns the ID of the master key
+func (keyring *Keyring) Wrap(dataKey []byte) (string, []byte, error) {
+	keyring.mutex.RLock()
+	defer keyring.mutex.RUnlock()
+	wrapped, err := Seal(keyring.keys[keyring.currentID], dataKey)
+	return keyring.currentID, wrapped, err
+}
+
+// Unwrap decrypts the data key wrapped by the master key of the ID
+func (keyring *Keyring) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	keyring.mutex.RLock()
+	defer keyring.mutex.RUnlock()
+	masterKey, ok := keyring.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	return Open(masterKey, wrapped)
+}
+
+// Rotate replaces the master key with a new random key. The current key is
+// retired along with the retired keys of the given IDs, those still wrapping
+// data keys, so that these can be unwrapped until they are wrapped again. The
+// other retired keys are forgotten.
+func (keyring *Keyring) Rotate(inUse map[string]bool) (string, error) {
+	keyring.mutex.Lock()
+	defer keyring.mutex.Unlock()
+	newKey, err := NewKey()
+	if err != nil {
+		return "", err
+	}
+	retired := [][]byte{keyring.keys[keyring.currentID]}
+	keys := map[string][]byte{keyring.currentID: retired[0]}
+	for id, key := range keyring.keys {
+		if id != keyring.currentID && inUse[id] {
+			retired = append(retired, key)
+			keys[id] = key
+		}
+	}
+	if err := writeKeyFile(keyring.path+".previous", retired...); err != nil {
+		return "", err
+	}
+	if err := writeKeyFile(keyring.path, newKey); err != nil {
+		return "", err
+	}
+	keyring.currentID = getKeyID(newKey)
+	keys[keyring.currentID] = newKey
+	keyring.keys = keys
+	return keyring.currentID, nil
+}
+
+// HasKey checks if the master key of the ID is available
+func (keyring *Keyring) HasKey(keyID string) bool {
+	keyring.mutex.RLock()
+	defer keyring.mutex.RUnlock()
+	_, ok := keyring.keys[keyID]
+	return ok
+}
+
+// NewKey returns a random key
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Seal encrypts the data with AES-256-GCM under the key. The result starts with
+// a marker telling it apart from plain data, followed by the nonce.
+func Seal(key, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte{}, sealedPrefix...), nonce...)
+	return aead.Seal(sealed, nonce, plaintext, nil), nil
+}
+
+// Open decrypts the data sealed by Seal under the key
+func Open(key, sealed []byte) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, errors.New("data is not encrypted")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[len(sealedPrefix):]
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data: %v", err)
+	}
+	return plaintext, nil
+}
+
+// IsSealed checks if the data was sealed by Seal
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealedPrefix)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// getKeyID returns the ID of a master key, derived from its hash
+func getKeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
+
+// readKeyFile reads the base64 encoded AES-256 keys of a key file, one per line
+func readKeyFile(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading master key: %w", err)
+	}
+	var keys [][]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("master key %s must hold %d base64 encoded bytes per line", path, KeySize)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("master key %s is empty", path)
+	}
+	return keys, nil
+}
+
+// writeKeyFile replaces the key file with the keys, through a temporary file so
+// that the file always holds whole keys
+func writeKeyFile(path string, keys ...[]byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error writing master key: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	var lines strings.Builder
+	for _, key := range keys {
+		lines.WriteString(base64.StdEncoding.EncodeToString(key) + "\n")
+	}
+	_, err = tmpFile.WriteString(lines.String())
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing master key: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestKeyring writes a master key file in a temporary directory and loads it
+func newTestKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "master.key")
+	if err := writeKeyFile(path, key); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestSealOpen(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("kind: Secret\ndata: {password: cGFzcw==}\n")
+	sealed, err := Seal(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, plaintext) {
+		t.Fatalf("Seal = %q, want the data encrypted", sealed)
+	}
+	opened, err := Open(key, sealed)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Open = %q, want %q", opened, plaintext)
+	}
+	if again, _ := Seal(key, plaintext); bytes.Equal(again, sealed) {
+		t.Errorf("Seal used the same nonce twice")
+	}
+}
+
+func TestOpenFails(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := Seal(key, []byte("kind: Secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tamper flips a byte of a copy of the sealed data
+	tamper := func(i int) []byte {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 0x01
+		return tampered
+	}
+	tests := []struct {
+		name    string
+		key     []byte
+		data    []byte
+		wantErr string
+	}{
+		{"wrong key", otherKey, sealed, "error decrypting data"},
+		{"tampered ciphertext", key, tamper(len(sealed) - 1), "error decrypting data"},
+		{"tampered nonce", key, tamper(len(sealedPrefix)), "error decrypting data"},
+		{"truncated data", key, sealed[:len(sealedPrefix)+4], "truncated"},
+		{"plain data", key, []byte("kind: Secret\n"), "not encrypted"},
+		{"key of the wrong size", key[:10], sealed, "invalid key size"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opened, err := Open(test.key, test.data)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Open = %q, %v, want an error containing %q", opened, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyringRotate(t *testing.T) {
+	keyring := newTestKeyring(t)
+	dataKey, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID, wrapped, err := keyring.Wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldID != keyring.KeyID() {
+		t.Errorf("Wrap used key %s, want the current key %s", oldID, keyring.KeyID())
+	}
+
+	newID, err := keyring.Rotate(nil)
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if newID == oldID || keyring.KeyID() != newID {
+		t.Errorf("KeyID = %s after rotating from %s to %s", keyring.KeyID(), oldID, newID)
+	}
+	// The data key stays readable with the retired key until it is wrapped again
+	unwrapped, err := keyring.Unwrap(oldID, wrapped)
+	if err != nil {
+		t.Fatalf("Unwrap with the retired key: %v", err)
+	}
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("Unwrap = %x, want %x", unwrapped, dataKey)
+	}
+	rewrappedID, rewrapped, err := keyring.Wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrappedID != newID {
+		t.Errorf("Wrap used key %s after rotating, want %s", rewrappedID, newID)
+	}
+
+	// Both keys are written to disk
+	reloaded, err := LoadKeyring(keyring.path)
+	if err != nil {
+		t.Fatalf("LoadKeyring after rotating: %v", err)
+	}
+	if reloaded.KeyID() != newID {
+		t.Errorf("reloaded KeyID = %s, want %s", reloaded.KeyID(), newID)
+	}
+	for id, sealed := range map[string][]byte{oldID: wrapped, newID: rewrapped} {
+		if unwrapped, err := reloaded.Unwrap(id, sealed); err != nil || !bytes.Equal(unwrapped, dataKey) {
+			t.Errorf("reloaded Unwrap(%s) = %x, %v, want %x", id, unwrapped, err, dataKey)
+		}
+	}
+	if _, err := reloaded.Unwrap("0123456789abcdef", wrapped); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Unwrap with an unknown key = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestKeyringRotateKeepsKeysInUse(t *testing.T) {
+	keyring := newTestKeyring(t)
+	// Rotate three times keeping every key, so that three keys are retired
+	ids := []string{keyring.KeyID()}
+	inUse := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		inUse[ids[i]] = true
+		id, err := keyring.Rotate(inUse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if !keyring.HasKey(id) {
+			t.Fatalf("key %s forgotten before the test rotation", id)
+		}
+	}
+	first, second, third, current := ids[0], ids[1], ids[2], ids[3]
+
+	newID, err := keyring.Rotate(map[string]bool{first: true, "0123456789abcdef": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		// Still wrapping data keys
+		first: true,
+		// Neither in use nor current
+		second: false,
+		third:  false,
+		// The key being replaced is always retired
+		current: true,
+		newID:   true,
+		// Unknown IDs in use are ignored
+		"0123456789abcdef": false,
+	}
+	reloaded, err := LoadKeyring(keyring.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, kept := range want {
+		if got := keyring.HasKey(id); got != kept {
+			t.Errorf("HasKey(%s) = %v, want %v", id, got, kept)
+		}
+		if got := reloaded.HasKey(id); got != kept {
+			t.Errorf("reloaded HasKey(%s) = %v, want %v", id, got, kept)
+		}
+	}
+}
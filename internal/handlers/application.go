@@ -2,23 +2,57 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/arzzon/app-backup-restore/internal/utils/fileUtils"
+	"github.com/arzzon/app-backup-restore/internal/constants"
+	"github.com/arzzon/app-backup-restore/internal/storage"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/arzzon/app-backup-restore/internal/types"
 )
 
+// appsMutex serializes the changes to the stored applications
+var appsMutex sync.Mutex
+
+var errAppNotFound = errors.New("application not found")
+
 func ApplicationDataHandler(w http.ResponseWriter, r *http.Request) {
+	appID := getPathID(r.URL.Path, "/application/")
 	switch r.Method {
 	case http.MethodPut:
-		StoreAppData(w, r)
+		if appID == "" {
+			StoreAppData(w, r)
+		} else {
+			UpdateAppData(w, r, false)
+		}
+	case http.MethodPatch:
+		UpdateAppData(w, r, true)
+	case http.MethodGet:
+		switch {
+		case appID == "":
+			ListAppData(w, r)
+		case strings.HasSuffix(appID, "/history"):
+			GetAppHistory(w, r)
+		default:
+			GetAppData(w, r)
+		}
+	case http.MethodDelete:
+		DeleteAppData(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-// StoreAppData stores the application data
+// StoreAppData stores the application data. An application that is already
+// stored gets the data as its new version, as with PUT /application/<id>.
 func StoreAppData(w http.ResponseWriter, r *http.Request) {
 	var app types.Application
 	err := json.NewDecoder(r.Body).Decode(&app)
@@ -27,11 +61,29 @@ func StoreAppData(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := validateApplication(app); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Generate app ID
-	appID := fmt.Sprintf("%s-%s", app.Name, app.Namespace)
+	appID := fmt.Sprintf("%s-%s", app.Name, getAppNamespaces(app)[0])
 
 	// Store application metadata
+	appsMutex.Lock()
+	defer appsMutex.Unlock()
+	app.ID = appID
+	app.Version = 0
+	app.CreatedAt = time.Now().UTC()
+	// Storing an application again replaces its definition with a new version
+	current, err := readApplication(appID)
+	if err == nil {
+		app.Version = current.Version
+		app.CreatedAt = current.CreatedAt
+	} else if err != errAppNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	if err := storeApplicationMetaData(appID, app); err != nil {
 		fmt.Printf("[Application Handler] Error storing application metadata: %v\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -49,22 +101,317 @@ func StoreAppData(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonResponse)
-	fmt.Printf("[Application Handler] Application data stored successfully")
+	fmt.Printf("[Application Handler] Application data stored successfully\n")
 }
 
-// storeApplicationMetaData saves the application data
-func storeApplicationMetaData(appID string, app types.Application) error {
-	fileName := "store/apps/" + appID
-	if fileUtils.CheckFile(fileName) {
-		return nil
+// ListAppData lists the stored applications
+func ListAppData(w http.ResponseWriter, r *http.Request) {
+	files, err := store.List(constants.APPS_DIR)
+	if err != nil {
+		fmt.Printf("[Application Handler] Error listing applications: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	apps := []types.Application{}
+	for _, file := range files {
+		app, err := readApplication(strings.TrimPrefix(file, constants.APPS_DIR+"/"))
+		if err != nil {
+			fmt.Printf("[Application Handler] Error reading application %s: %v\n", file, err)
+			continue
+		}
+		apps = append(apps, *app)
+	}
+	writeJSONResponse(w, http.StatusOK, apps)
+}
+
+// GetAppData returns the current definition of the application
+func GetAppData(w http.ResponseWriter, r *http.Request) {
+	app, err := readApplication(getPathID(r.URL.Path, "/application/"))
+	if err != nil {
+		http.Error(w, err.Error(), getAppStatusCode(err))
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, app)
+}
+
+// GetAppHistory returns every version of the application, oldest first
+func GetAppHistory(w http.ResponseWriter, r *http.Request) {
+	appID := strings.TrimSuffix(getPathID(r.URL.Path, "/application/"), "/history")
+	if _, err := readApplication(appID); err != nil {
+		http.Error(w, err.Error(), getAppStatusCode(err))
+		return
+	}
+	files, err := store.List(getAppHistoryDir(appID))
+	if err != nil {
+		fmt.Printf("[Application Handler] Error listing history of %s: %v\n", appID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	history := []types.Application{}
+	for _, file := range files {
+		appData, err := store.Get(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var app types.Application
+		if err := json.Unmarshal(appData, &app); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		history = append(history, app)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Version < history[j].Version
+	})
+	writeJSONResponse(w, http.StatusOK, history)
+}
+
+// UpdateAppData stores a new version of the application. With patch only the
+// fields present in the request body are changed, otherwise the body replaces
+// the definition. The ID and name of an application never change.
+func UpdateAppData(w http.ResponseWriter, r *http.Request, patch bool) {
+	appID := getPathID(r.URL.Path, "/application/")
+	appsMutex.Lock()
+	defer appsMutex.Unlock()
+	current, err := readApplication(appID)
+	if err != nil {
+		http.Error(w, err.Error(), getAppStatusCode(err))
+		return
+	}
+
+	var app types.Application
+	if patch {
+		app = *current
+	}
+	if err := json.NewDecoder(r.Body).Decode(&app); err != nil {
+		fmt.Printf("[Application Handler] Error unmarshalling request body: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if app.Name != "" && app.Name != current.Name {
+		http.Error(w, "The name of an application cannot be changed", http.StatusBadRequest)
+		return
+	}
+	app.ID = current.ID
+	app.Name = current.Name
+	app.Version = current.Version
+	app.CreatedAt = current.CreatedAt
+	if err := validateApplication(app); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := storeApplicationMetaData(appID, app); err != nil {
+		fmt.Printf("[Application Handler] Error storing application metadata: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	updated, err := readApplication(appID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, updated)
+	fmt.Printf("[Application Handler] Application %s updated to version %d\n", appID, updated.Version)
+}
+
+// DeleteAppData deletes the application, its history and its schedules. With the
+// cascade query parameter set to true the backups of the application are deleted
+// first, and nothing is deleted if any of them cannot be.
+func DeleteAppData(w http.ResponseWriter, r *http.Request) {
+	appID := getPathID(r.URL.Path, "/application/")
+	cascade, _ := strconv.ParseBool(r.URL.Query().Get("cascade"))
+	appsMutex.Lock()
+	defer appsMutex.Unlock()
+	if _, err := readApplication(appID); err != nil {
+		http.Error(w, err.Error(), getAppStatusCode(err))
+		return
+	}
+
+	response := map[string]interface{}{"appId": appID}
+	if cascade {
+		deletedBackups, err := deleteAppBackups(appID)
+		if err != nil {
+			fmt.Printf("[Application Handler] Error deleting backups of %s: %v\n", appID, err)
+			http.Error(w, err.Error(), getDeleteBackupStatusCode(errors.Unwrap(err)))
+			return
+		}
+		response["deletedBackups"] = deletedBackups
+	}
+	deletedSchedules, err := deleteAppSchedules(appID)
+	response["deletedSchedules"] = deletedSchedules
+	if err != nil {
+		fmt.Printf("[Application Handler] Error deleting schedules of %s: %v\n", appID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := storage.DeletePrefix(store, getAppHistoryDir(appID)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := store.Delete(getAppFilePath(appID)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, response)
+	fmt.Printf("[Application Handler] Application %s deleted\n", appID)
+}
+
+// deleteAppBackups deletes every backup taken of the application. All of them
+// are checked before any is deleted, so that a backup in progress, being
+// restored or under legal hold leaves them all in place.
+func deleteAppBackups(appID string) ([]string, error) {
+	deletedBackups := []string{}
+	backupIDs, err := storage.ListChildren(store, constants.BACKUPS_DIR)
+	if err != nil {
+		return deletedBackups, err
+	}
+	activeRestores.Lock()
+	defer activeRestores.Unlock()
+	if isAppBackupInProgress(appID) {
+		return deletedBackups, fmt.Errorf("error deleting backups of %s: %w", appID, errBackupInProgress)
+	}
+	var appBackupIDs []string
+	for _, backupID := range backupIDs {
+		manifest, err := readBackupManifest(backupID)
+		if err != nil || manifest.AppID != appID {
+			continue
+		}
+		if err := checkBackupDeletable(backupID); err != nil {
+			return deletedBackups, fmt.Errorf("error deleting backup %s: %w", backupID, err)
+		}
+		appBackupIDs = append(appBackupIDs, backupID)
+	}
+	for _, backupID := range appBackupIDs {
+		if err := removeBackup(backupID); err != nil {
+			return deletedBackups, fmt.Errorf("error deleting backup %s: %w", backupID, err)
+		}
+		deletedBackups = append(deletedBackups, backupID)
+	}
+	return deletedBackups, nil
+}
+
+// storeApplicationMetaData saves the application data as a new version and
+// records it in the application's history
+func storeApplicationMetaData(appID string, app types.Application) error {
+	app.Version++
+	app.UpdatedAt = time.Now().UTC()
 	// Encode the object to JSON format
 	appData, err := json.Marshal(app)
 	if err != nil {
 		return fmt.Errorf("Error encoding object to JSON: %v", err)
 	}
-	if err := fileUtils.WriteFile(fileName, appData); err != nil {
+	historyKey := storage.Join(getAppHistoryDir(appID), fmt.Sprintf("%d.json", app.Version))
+	if err := store.Put(historyKey, appData); err != nil {
+		return fmt.Errorf("Error storing application history: %v", err)
+	}
+	if err := store.Put(getAppFilePath(appID), appData); err != nil {
 		return fmt.Errorf("Error storing application details: %v", err)
 	}
 	return nil
 }
+
+// readApplication reads the current definition of the application
+func readApplication(appID string) (*types.Application, error) {
+	if !isValidID(appID) || !storage.Exists(store, getAppFilePath(appID)) {
+		return nil, errAppNotFound
+	}
+	appData, err := store.Get(getAppFilePath(appID))
+	if err != nil {
+		return nil, err
+	}
+	var app types.Application
+	if err := json.Unmarshal(appData, &app); err != nil {
+		return nil, err
+	}
+	// Applications stored before versioning was introduced
+	if app.ID == "" {
+		app.ID = appID
+	}
+	return &app, nil
+}
+
+// validateApplication checks that the application definition is complete
+func validateApplication(app types.Application) error {
+	if app.Name == "" || len(getAppNamespaces(app)) == 0 {
+		return errors.New("Application name and namespace are required")
+	}
+	if app.Namespace != "" && len(app.Namespaces) > 0 {
+		return errors.New("Application namespace and namespaces cannot both be set")
+	}
+	if err := validateNamespaces(getAppNamespaces(app)); err != nil {
+		return err
+	}
+	if _, err := labels.Parse(app.LabelSelector); err != nil {
+		return fmt.Errorf("Invalid label selector: %v", err)
+	}
+	if _, err := fields.ParseSelector(app.FieldSelector); err != nil {
+		return fmt.Errorf("Invalid field selector: %v", err)
+	}
+	if app.Mode != "" && app.Mode != types.TypedMode && app.Mode != types.DiscoveryMode {
+		return fmt.Errorf("Invalid backup mode: %s", app.Mode)
+	}
+	if err := validateNamePatterns(app.ExcludedNames); err != nil {
+		return err
+	}
+	if err := validateSanitizeRules(app.SanitizeRules); err != nil {
+		return err
+	}
+	if err := validateEncryptionScope(app.Encryption); err != nil {
+		return err
+	}
+	if err := validateRetentionPolicy(app.Retention); err != nil {
+		return err
+	}
+	if err := validateBackupHooks(app.PreHooks, getAppNamespaces(app)); err != nil {
+		return err
+	}
+	if err := validateBackupHooks(app.PostHooks, getAppNamespaces(app)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getAppNamespaces returns the namespaces of the application
+func getAppNamespaces(app types.Application) []string {
+	if len(app.Namespaces) > 0 {
+		return app.Namespaces
+	}
+	if app.Namespace != "" {
+		return []string{app.Namespace}
+	}
+	return nil
+}
+
+// validateNamespaces checks that the namespaces are valid and distinct
+func validateNamespaces(namespaces []string) error {
+	seen := make(map[string]bool, len(namespaces))
+	for _, namespace := range namespaces {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return fmt.Errorf("Invalid namespace %q: %s", namespace, strings.Join(errs, ", "))
+		}
+		if seen[namespace] {
+			return fmt.Errorf("Namespace %s is listed twice", namespace)
+		}
+		seen[namespace] = true
+	}
+	return nil
+}
+
+// getAppStatusCode maps application lookup errors to HTTP status codes
+func getAppStatusCode(err error) int {
+	if err == errAppNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func getAppFilePath(appID string) string {
+	return storage.Join(constants.APPS_DIR, appID)
+}
+
+func getAppHistoryDir(appID string) string {
+	return storage.Join(constants.APP_HISTORY_DIR, appID)
+}
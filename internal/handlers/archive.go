@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/constants"
+	"github.com/arzzon/app-backup-restore/internal/storage"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Compressions of a backup archive
+const (
+	archiveGzip = "gzip"
+	archiveZstd = "zstd"
+)
+
+// Magic numbers of the compressed streams, used to detect the compression of
+// an imported archive
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var errBackupExists = errors.New("backup already exists")
+
+var errArchiveTooLarge = errors.New("archive too large once decompressed")
+
+// ExportBackup streams the manifest, report and YAML files of the backup as a
+// tar archive, compressed with gzip or with zstd when the compression query
+// parameter asks for it
+func ExportBackup(w http.ResponseWriter, r *http.Request) {
+	backupID := strings.TrimSuffix(getPathID(r.URL.Path, "/backup/"), "/archive")
+	compression := r.URL.Query().Get("compression")
+	if compression == "" {
+		compression = archiveGzip
+	}
+	if compression != archiveGzip && compression != archiveZstd {
+		http.Error(w, fmt.Sprintf("Invalid compression %s, use gzip or zstd", compression), http.StatusBadRequest)
+		return
+	}
+	if !isValidID(backupID) || !checkIfBackupStored(backupID) {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	if isBackupInProgress(backupID) {
+		http.Error(w, errBackupInProgress.Error(), http.StatusConflict)
+		return
+	}
+	manifest, err := verifyBackupManifest(backupID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Backup verification failed: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	keys, err := store.List(getBackupDir(backupID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fileName := backupID + ".tar.gz"
+	contentType := "application/gzip"
+	if compression == archiveZstd {
+		fileName = backupID + ".tar.zst"
+		contentType = "application/zstd"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	w.WriteHeader(http.StatusOK)
+
+	// The response has started, errors can only cut the archive short
+	if err := writeBackupArchive(w, compression, manifest, keys); err != nil {
+		fmt.Printf("[Backup] Error exporting backup %s: %v\n", backupID, err)
+		return
+	}
+	fmt.Printf("[Backup] Backup %s exported\n", backupID)
+}
+
+// writeBackupArchive writes the stored files of the backup, given by their
+// keys, as a compressed tar archive with paths relative to the backup directory
+func writeBackupArchive(w io.Writer, compression string, manifest *BackupManifest, keys []string) error {
+	var compressor io.WriteCloser
+	var err error
+	if compression == archiveZstd {
+		compressor, err = zstd.NewWriter(w)
+	} else {
+		compressor = gzip.NewWriter(w)
+	}
+	if err != nil {
+		return err
+	}
+	tarWriter := tar.NewWriter(compressor)
+	dirPath := getBackupDir(manifest.BackupID)
+	for _, key := range keys {
+		data, err := store.Get(key)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimPrefix(key, dirPath+"/"),
+			Mode:     0644,
+			Size:     int64(len(data)),
+			ModTime:  manifest.Timestamp,
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tarWriter.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// ImportBackup registers the backup of a tar.gz or tar.zst archive made by
+// ExportBackup. The archive is checked against its manifest before anything
+// is stored. The backup gets a new ID unless preserveId is true.
+func ImportBackup(w http.ResponseWriter, r *http.Request) {
+	preserveID, _ := strconv.ParseBool(r.URL.Query().Get("preserveId"))
+	files, err := readBackupArchive(http.MaxBytesReader(w, r.Body, constants.ARCHIVE_MAX_SIZE), constants.ARCHIVE_MAX_SIZE)
+	if err != nil {
+		fmt.Printf("[Backup] Error reading backup archive: %v\n", err)
+		http.Error(w, fmt.Sprintf("Invalid backup archive: %v", err), http.StatusBadRequest)
+		return
+	}
+	manifest, err := verifyBackupArchive(files)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Backup verification failed: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	backupID := manifest.BackupID
+	if !preserveID {
+		newID, err := uuid.NewRandom()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		backupID = newID.String()
+	}
+	if err := storeImportedBackup(backupID, manifest, files); err != nil {
+		fmt.Printf("[Backup] Error importing backup %s: %v\n", backupID, err)
+		statusCode := http.StatusInternalServerError
+		if err == errBackupExists {
+			statusCode = http.StatusConflict
+		}
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
+	fmt.Printf("[Backup] Backup %s imported as %s\n", manifest.BackupID, backupID)
+	writeJSONResponse(w, http.StatusOK, getBackUpResponse(manifest.AppID, backupID, "Backup imported successfully"))
+}
+
+// readBackupArchive decompresses the archive and returns its files by path.
+// Only regular files with clean relative paths are accepted, and the
+// decompressed archive cannot exceed maxSize bytes. The files are held in
+// memory until they are verified.
+func readBackupArchive(body io.Reader, maxSize int64) (map[string][]byte, error) {
+	reader := bufio.NewReader(body)
+	magic, _ := reader.Peek(len(zstdMagic))
+	var decompressed io.Reader
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		decompressed = gzipReader
+	case bytes.HasPrefix(magic, zstdMagic):
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer zstdReader.Close()
+		decompressed = zstdReader
+	default:
+		return nil, errors.New("not a gzip or zstd compressed archive")
+	}
+
+	files := make(map[string][]byte)
+	limited := &io.LimitedReader{R: decompressed, N: maxSize}
+	tarReader := tar.NewReader(limited)
+	for {
+		header, err := tarReader.Next()
+		// Running out of the limit between two entries ends the archive as well
+		if err != nil && limited.N <= 0 {
+			return nil, fmt.Errorf("%w: over %d bytes", errArchiveTooLarge, maxSize)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("entry %s is not a regular file", header.Name)
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if strings.Contains(name, `\`) || storage.ValidateKey(name) != nil {
+			return nil, fmt.Errorf("invalid path %q", header.Name)
+		}
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("duplicate entry %s", name)
+		}
+		if header.Size > limited.N {
+			return nil, fmt.Errorf("%w: over %d bytes", errArchiveTooLarge, maxSize)
+		}
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// verifyBackupArchive checks that the files of an archive are a backup: a
+// manifest, an optional report, and YAML files matching the manifest checksums
+func verifyBackupArchive(files map[string][]byte) (*BackupManifest, error) {
+	manifestData, ok := files[constants.BACKUP_MANIFEST_FILE]
+	if !ok {
+		return nil, fmt.Errorf("%s is missing", constants.BACKUP_MANIFEST_FILE)
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %v", err)
+	}
+	if !isValidID(manifest.BackupID) {
+		return nil, fmt.Errorf("invalid backup ID %q in manifest", manifest.BackupID)
+	}
+	checksums := make(map[string]string)
+	for name, data := range files {
+		switch {
+		case name == constants.BACKUP_MANIFEST_FILE || name == constants.BACKUP_REPORT_FILE:
+		case strings.HasSuffix(name, ".yaml"):
+			checksums[name] = getChecksum(data)
+		default:
+			return nil, fmt.Errorf("unexpected file %s", name)
+		}
+	}
+	if err := compareChecksums(&manifest, checksums); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// storeImportedBackup stores the files of an imported backup under the backup
+// ID, with the manifest written last so that the backup is only listed once
+// complete. The restore registry stays locked so that the backup cannot be
+// restored or deleted meanwhile.
+func storeImportedBackup(backupID string, manifest *BackupManifest, files map[string][]byte) error {
+	activeRestores.Lock()
+	defer activeRestores.Unlock()
+	if checkIfBackupStored(backupID) {
+		return errBackupExists
+	}
+
+	dirPath := getBackupDir(backupID)
+	if backupID != manifest.BackupID {
+		manifest.BackupID = backupID
+		manifestData, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Error encoding manifest to JSON: %v", err)
+		}
+		files[constants.BACKUP_MANIFEST_FILE] = manifestData
+		if reportData, ok := files[constants.BACKUP_REPORT_FILE]; ok {
+			var report BackupReport
+			if err := json.Unmarshal(reportData, &report); err != nil {
+				return fmt.Errorf("error decoding report: %v", err)
+			}
+			report.BackupID = backupID
+			if reportData, err = json.MarshalIndent(report, "", "  "); err != nil {
+				return fmt.Errorf("Error encoding report to JSON: %v", err)
+			}
+			files[constants.BACKUP_REPORT_FILE] = reportData
+		}
+	}
+	for name, data := range files {
+		if name == constants.BACKUP_MANIFEST_FILE {
+			continue
+		}
+		if err := store.Put(storage.Join(dirPath, name), data); err != nil {
+			storage.DeletePrefix(store, dirPath)
+			return err
+		}
+	}
+	if err := store.Put(storage.Join(dirPath, constants.BACKUP_MANIFEST_FILE), files[constants.BACKUP_MANIFEST_FILE]); err != nil {
+		storage.DeletePrefix(store, dirPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// archiveEntry is an entry of a test archive. Entries with a size larger than
+// their data end the archive after their header.
+type archiveEntry struct {
+	header tar.Header
+	data   string
+}
+
+func regularEntry(name, data string) archiveEntry {
+	return archiveEntry{header: tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}, data: data}
+}
+
+// buildArchive writes the entries as a tar archive compressed with gzip or zstd
+func buildArchive(t *testing.T, compression string, entries []archiveEntry) []byte {
+	t.Helper()
+	var archive bytes.Buffer
+	var compressor io.WriteCloser
+	if compression == archiveZstd {
+		zstdWriter, err := zstd.NewWriter(&archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressor = zstdWriter
+	} else {
+		compressor = gzip.NewWriter(&archive)
+	}
+	tarWriter := tar.NewWriter(compressor)
+	truncated := false
+	for _, entry := range entries {
+		header := entry.header
+		if err := tarWriter.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(entry.data)); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > int64(len(entry.data)) {
+			truncated = true
+			break
+		}
+	}
+	if !truncated {
+		if err := tarWriter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := compressor.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestReadBackupArchive(t *testing.T) {
+	const maxSize = 8192
+	tests := []struct {
+		name      string
+		entries   []archiveEntry
+		wantFiles map[string][]byte
+		wantErr   string
+		tooLarge  bool
+	}{
+		{
+			name: "regular files and directories",
+			entries: []archiveEntry{
+				{header: tar.Header{Name: "ns1/", Typeflag: tar.TypeDir, Mode: 0755}},
+				regularEntry("./manifest.json", "{}"),
+				regularEntry("ns1/ConfigMap/cm1.yaml", "kind: ConfigMap\n"),
+			},
+			wantFiles: map[string][]byte{
+				"manifest.json":          []byte("{}"),
+				"ns1/ConfigMap/cm1.yaml": []byte("kind: ConfigMap\n"),
+			},
+		},
+		{
+			name:    "absolute path",
+			entries: []archiveEntry{regularEntry("/etc/cron.d/job", "* * * * * root sh")},
+			wantErr: "invalid path",
+		},
+		{
+			name:    "parent directory",
+			entries: []archiveEntry{regularEntry("../escape.yaml", "kind: ConfigMap\n")},
+			wantErr: "invalid path",
+		},
+		{
+			name:    "parent directory inside the path",
+			entries: []archiveEntry{regularEntry("ns1/../../escape.yaml", "kind: ConfigMap\n")},
+			wantErr: "invalid path",
+		},
+		{
+			name:    "backslash in the path",
+			entries: []archiveEntry{regularEntry(`ns1\..\escape.yaml`, "kind: ConfigMap\n")},
+			wantErr: "invalid path",
+		},
+		{
+			name:    "symbolic link",
+			entries: []archiveEntry{{header: tar.Header{Name: "manifest.json", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}},
+			wantErr: "not a regular file",
+		},
+		{
+			name:    "hard link",
+			entries: []archiveEntry{{header: tar.Header{Name: "ns1/ConfigMap/cm1.yaml", Typeflag: tar.TypeLink, Linkname: "manifest.json"}}},
+			wantErr: "not a regular file",
+		},
+		{
+			name:    "duplicate entry",
+			entries: []archiveEntry{regularEntry("manifest.json", "{}"), regularEntry("./manifest.json", "{}")},
+			wantErr: "duplicate entry",
+		},
+		{
+			// Only the header of the entry is written, its size is refused
+			// before anything is read
+			name:     "entry larger than the limit",
+			entries:  []archiveEntry{{header: tar.Header{Name: "big.yaml", Typeflag: tar.TypeReg, Mode: 0644, Size: 1 << 20}}},
+			tooLarge: true,
+		},
+		{
+			// The limit runs out right after the first entry, which must not
+			// be taken for the end of the archive
+			name:     "entries ending at the limit",
+			entries:  []archiveEntry{regularEntry("a.yaml", strings.Repeat("a", maxSize-512)), regularEntry("b.yaml", "b")},
+			tooLarge: true,
+		},
+		{
+			name: "entries larger than the limit together",
+			entries: []archiveEntry{
+				regularEntry("a.yaml", strings.Repeat("a", 3000)),
+				regularEntry("b.yaml", strings.Repeat("b", 3000)),
+				regularEntry("c.yaml", strings.Repeat("c", 3000)),
+			},
+			tooLarge: true,
+		},
+	}
+	for _, compression := range []string{archiveGzip, archiveZstd} {
+		for _, test := range tests {
+			t.Run(compression+"/"+test.name, func(t *testing.T) {
+				files, err := readBackupArchive(bytes.NewReader(buildArchive(t, compression, test.entries)), maxSize)
+				switch {
+				case test.tooLarge:
+					if !errors.Is(err, errArchiveTooLarge) {
+						t.Errorf("readBackupArchive = %v, want %v", err, errArchiveTooLarge)
+					}
+				case test.wantErr != "":
+					if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+						t.Errorf("readBackupArchive = %v, want an error containing %q", err, test.wantErr)
+					}
+				case err != nil:
+					t.Errorf("readBackupArchive: %v", err)
+				case !reflect.DeepEqual(files, test.wantFiles):
+					t.Errorf("files = %q, want %q", files, test.wantFiles)
+				}
+			})
+		}
+	}
+}
+
+func TestReadBackupArchiveRejectsUncompressed(t *testing.T) {
+	var archive bytes.Buffer
+	tarWriter := tar.NewWriter(&archive)
+	tarWriter.Close()
+	if _, err := readBackupArchive(&archive, 1024); err == nil || !strings.Contains(err.Error(), "not a gzip or zstd") {
+		t.Errorf("readBackupArchive = %v, want an error for the missing compression", err)
+	}
+}
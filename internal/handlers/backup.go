@@ -3,14 +3,20 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/arzzon/app-backup-restore/internal/constants"
+	"github.com/arzzon/app-backup-restore/internal/encryption"
+	"github.com/arzzon/app-backup-restore/internal/storage"
 	. "github.com/arzzon/app-backup-restore/internal/types"
-	"github.com/arzzon/app-backup-restore/internal/utils/fileUtils"
 	"github.com/arzzon/app-backup-restore/internal/utils/orchestratorClient"
 	"github.com/google/uuid"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"net/http"
@@ -22,6 +28,26 @@ func BackupHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPut:
 		BackUpApplication(w, r)
+	case http.MethodPost:
+		if getPathID(r.URL.Path, "/backup/") == "import" {
+			ImportBackup(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case http.MethodGet:
+		backupID := getPathID(r.URL.Path, "/backup/")
+		switch {
+		case backupID == "":
+			ListBackups(w, r)
+		case strings.HasSuffix(backupID, "/archive"):
+			ExportBackup(w, r)
+		default:
+			GetBackup(w, r)
+		}
+	case http.MethodPatch:
+		UpdateBackupHold(w, r)
+	case http.MethodDelete:
+		DeleteBackup(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
@@ -45,8 +71,8 @@ func BackUpApplication(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if the app data is saved
-	appNamespace := getAppNamespace(backupReq.AppID)
-	if appNamespace == "" {
+	app, err := readApplication(backupReq.AppID)
+	if err != nil {
 		backupResponse = getBackUpResponse(backupReq.AppID, backUpID.String(), "Application data not found")
 		jsonResponse, err := json.Marshal(backupResponse)
 		if err != nil {
@@ -59,221 +85,787 @@ func BackUpApplication(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// List of all resources to backup
-	//allResources := []types.ResourceKind{types.Pod}
-	//backupCompletionUpdateMutex := &sync.Mutex{}
-	wg := &sync.WaitGroup{}
-	for _, resource := range AllResources {
-		wg.Add(1)
-		backupChan := BackupJob{
-			Kind:      resource,
-			BackupID:  backUpID.String(),
-			Namespace: appNamespace,
-			Wg:        wg,
-			//completionStatusUpdateMutex: backupCompletionUpdateMutex,
-		}
-		BackUpWorkerPool <- backupChan
+	spec, err := getBackupSpec(*app, backupReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Start the backup asynchronously and let the client poll the task status
+	taskID, err := startBackup(*app, backUpID.String(), spec, getBackupTimeout(backupReq), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	wg.Wait() // TODO: Implement timeout/asynchronous status update
 
-	backupResponse = getBackUpResponse(backupReq.AppID, backUpID.String(), "Backup created successfully")
+	backupResponse = getBackUpResponse(backupReq.AppID, backUpID.String(), "Backup started")
+	backupResponse.TaskID = taskID
 	jsonResponse, err := json.Marshal(backupResponse)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(http.StatusAccepted)
 	w.Write(jsonResponse)
 }
 
+// startBackup starts the backup of the application as a task and returns the
+// task ID. The done function, if any, is called once the backup is finished.
+func startBackup(app Application, backupID string, spec backupSpec, timeout time.Duration, done func()) (string, error) {
+	taskID, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	if spec.Encryption != "" {
+		if spec.DataKey, err = encryption.NewKey(); err != nil {
+			return "", err
+		}
+	}
+	task, ctx := newTask(taskID.String(), app.ID, backupID, timeout)
+	go func() {
+		runBackup(ctx, task.ID, backupID, app, spec, task.StartTime)
+		endTask(task.ID)
+		if done != nil {
+			done()
+		}
+	}()
+	go pollTaskStatus(task.ID)
+	return task.ID, nil
+}
+
+// getBackupTimeout returns the timeout of the backup task
+func getBackupTimeout(backupReq BackupRequest) time.Duration {
+	if backupReq.TimeoutSeconds > 0 {
+		return time.Duration(backupReq.TimeoutSeconds) * time.Second
+	}
+	return constants.TASK_TIMEOUT * time.Second
+}
+
+// backupSpec is the effective configuration of a backup, combining the
+// application definition with the overrides of the backup request
+type backupSpec struct {
+	Mode          BackupMode
+	IncludedKinds []ResourceKind
+	ExcludedKinds []ResourceKind
+	ExcludedNames []string
+	SanitizeRules []SanitizeRule
+	// Encryption is the scope of the objects encrypted with DataKey
+	Encryption EncryptionScope
+	DataKey    []byte
+	// Schedule is the name of the schedule starting the backup, if any
+	Schedule string
+}
+
+// getBackupSpec combines the application definition with the backup request
+func getBackupSpec(app Application, backupReq BackupRequest) (backupSpec, error) {
+	spec := backupSpec{
+		Mode:          app.Mode,
+		IncludedKinds: app.IncludedKinds,
+		ExcludedKinds: append(append([]ResourceKind{}, app.ExcludedKinds...), backupReq.ExcludedKinds...),
+		ExcludedNames: append(append([]string{}, app.ExcludedNames...), backupReq.ExcludedNames...),
+		SanitizeRules: app.SanitizeRules,
+	}
+	if backupReq.Mode != "" {
+		spec.Mode = backupReq.Mode
+	}
+	if spec.Mode == "" {
+		spec.Mode = TypedMode
+	}
+	if spec.Mode != TypedMode && spec.Mode != DiscoveryMode {
+		return spec, fmt.Errorf("Invalid backup mode: %s", spec.Mode)
+	}
+	if len(backupReq.IncludedKinds) > 0 {
+		spec.IncludedKinds = backupReq.IncludedKinds
+	}
+	if err := validateNamePatterns(spec.ExcludedNames); err != nil {
+		return spec, err
+	}
+	encryptionScope, err := getEncryptionScope(app)
+	if err != nil {
+		return spec, err
+	}
+	spec.Encryption = encryptionScope
+	return spec, nil
+}
+
+// ListBackups lists the backups, optionally filtered by the app query
+// parameter and by a time range given as RFC 3339 from and to query parameters
+func ListBackups(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	appID := query.Get("app")
+	var from, to time.Time
+	var err error
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid from time: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid to time: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	backupIDs, err := storage.ListChildren(store, constants.BACKUPS_DIR)
+	if err != nil {
+		fmt.Printf("[Backup] Error listing backups: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	summaries := []BackupSummary{}
+	for _, backupID := range backupIDs {
+		// Backups still in progress have no manifest yet
+		manifest, legacy, err := getBackupManifest(backupID)
+		if err != nil {
+			continue
+		}
+		if appID != "" && manifest.AppID != appID {
+			continue
+		}
+		if (!from.IsZero() && manifest.Timestamp.Before(from)) || (!to.IsZero() && manifest.Timestamp.After(to)) {
+			continue
+		}
+		summary := BackupSummary{
+			BackupID:          manifest.BackupID,
+			AppID:             manifest.AppID,
+			Namespace:         manifest.Namespace,
+			Namespaces:        manifest.Namespaces,
+			ClusterServer:     manifest.ClusterServer,
+			KubernetesVersion: manifest.KubernetesVersion,
+			Timestamp:         manifest.Timestamp,
+			ToolVersion:       manifest.ToolVersion,
+			Schedule:          manifest.Schedule,
+			ObjectCounts:      manifest.ObjectCounts,
+			Pinned:            manifest.Pinned,
+			LegalHold:         manifest.LegalHold,
+			Unverified:        legacy,
+		}
+		if report, err := readBackupReport(backupID); err == nil {
+			summary.Status = report.Status
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Timestamp.Before(summaries[j].Timestamp)
+	})
+	writeJSONResponse(w, http.StatusOK, summaries)
+}
+
+// GetBackup returns the manifest, report and object inventory of the backup
+func GetBackup(w http.ResponseWriter, r *http.Request) {
+	backupID := getPathID(r.URL.Path, "/backup/")
+	if !isValidID(backupID) || !checkIfBackupStored(backupID) {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	manifest, legacy, err := getBackupManifest(backupID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	details := BackupDetails{
+		Manifest:   manifest,
+		Unverified: legacy,
+		Inventory:  make(map[ResourceKind][]string),
+	}
+	if report, err := readBackupReport(backupID); err == nil {
+		details.Report = report
+	}
+	for path := range manifest.Checksums {
+		namespace, kind, name := getObjectFromPath(path)
+		details.Inventory[kind] = append(details.Inventory[kind], getObjectKey(namespace, name))
+	}
+	for kind := range details.Inventory {
+		sort.Strings(details.Inventory[kind])
+	}
+	writeJSONResponse(w, http.StatusOK, details)
+}
+
+// UpdateBackupHold pins or unpins the backup and sets or lifts its legal hold,
+// returning the updated manifest
+func UpdateBackupHold(w http.ResponseWriter, r *http.Request) {
+	backupID := getPathID(r.URL.Path, "/backup/")
+	var holdReq BackupHoldRequest
+	if err := json.NewDecoder(r.Body).Decode(&holdReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !isValidID(backupID) || !checkIfBackupStored(backupID) {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	if isBackupInProgress(backupID) {
+		http.Error(w, errBackupInProgress.Error(), http.StatusConflict)
+		return
+	}
+	manifest, err := updateBackupManifest(backupID, func(manifest *BackupManifest) (bool, error) {
+		if holdReq.Pinned != nil {
+			manifest.Pinned = *holdReq.Pinned
+		}
+		if holdReq.LegalHold != nil {
+			manifest.LegalHold = *holdReq.LegalHold
+		}
+		return holdReq.Pinned != nil || holdReq.LegalHold != nil, nil
+	})
+	if err != nil {
+		fmt.Printf("[Backup] Error updating hold of backup %s: %v\n", backupID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("[Backup] Backup %s pinned: %t, legal hold: %t\n", backupID, manifest.Pinned, manifest.LegalHold)
+	writeJSONResponse(w, http.StatusOK, manifest)
+}
+
+// DeleteBackup deletes the backup, refusing while it is still being written,
+// while a restore from it is running or while it is under legal hold
+func DeleteBackup(w http.ResponseWriter, r *http.Request) {
+	backupID := getPathID(r.URL.Path, "/backup/")
+	if !isValidID(backupID) {
+		http.Error(w, "Invalid backup ID", http.StatusBadRequest)
+		return
+	}
+	if err := deleteBackup(backupID); err != nil {
+		fmt.Printf("[Backup] Error deleting backup %s: %v\n", backupID, err)
+		http.Error(w, err.Error(), getDeleteBackupStatusCode(err))
+		return
+	}
+	backupResponse := getBackUpResponse("", backupID, "Backup deleted successfully")
+	writeJSONResponse(w, http.StatusOK, backupResponse)
+}
+
+var (
+	errBackupNotFound   = errors.New("backup not found")
+	errBackupInProgress = errors.New("backup is still in progress")
+	errBackupRestoring  = errors.New("backup is being restored")
+	errBackupOnHold     = errors.New("backup is under legal hold")
+)
+
+// deleteBackup removes the backup directory. The restore registry stays locked
+// while deleting so that no restore from the backup can start meanwhile.
+func deleteBackup(backupID string) error {
+	activeRestores.Lock()
+	defer activeRestores.Unlock()
+	if err := checkBackupDeletable(backupID); err != nil {
+		return err
+	}
+	return removeBackup(backupID)
+}
+
+// checkBackupDeletable checks that the backup exists and is neither in
+// progress, being restored nor under legal hold. The caller must hold the
+// restore registry lock.
+func checkBackupDeletable(backupID string) error {
+	if !checkIfBackupStored(backupID) {
+		return errBackupNotFound
+	}
+	if isBackupInProgress(backupID) {
+		return errBackupInProgress
+	}
+	if activeRestores.backups[backupID] > 0 {
+		return errBackupRestoring
+	}
+	if manifest, err := readBackupManifest(backupID); err == nil && manifest.LegalHold {
+		return errBackupOnHold
+	}
+	return nil
+}
+
+// removeBackup deletes the files of the backup. The caller must hold the
+// restore registry lock.
+func removeBackup(backupID string) error {
+	if err := storage.DeletePrefix(store, getBackupDir(backupID)); err != nil {
+		return err
+	}
+	fmt.Printf("[Backup] Backup %s deleted\n", backupID)
+	return nil
+}
+
+// getDeleteBackupStatusCode maps the errors of deleteBackup to HTTP status codes
+func getDeleteBackupStatusCode(err error) int {
+	switch err {
+	case errBackupNotFound:
+		return http.StatusNotFound
+	case errBackupInProgress, errBackupRestoring, errBackupOnHold:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// runBackup hands a job per resource kind to the worker pool, persists the
+// backup report and manifest once all of them are done and finishes the task
+func runBackup(ctx context.Context, taskID, backupID string, app Application, spec backupSpec, startTime time.Time) {
+	appID := app.ID
+	namespaces := getAppNamespaces(app)
+	listOptions := getAppListOptions(app)
+	wg := &sync.WaitGroup{}
+	report := BackupReport{
+		BackupID: backupID,
+		AppID:    appID,
+		Kinds:    make(map[ResourceKind]*KindReport),
+	}
+
+	// In discovery mode each kind is backed up through its discovered API resource
+	resources := make(map[ResourceKind]*schema.GroupVersionResource)
+	kinds := AllResources
+	if spec.Mode == DiscoveryMode {
+		discovered, err := discoverResources()
+		if err != nil {
+			fmt.Printf("[Backup] Error discovering resources for %s: %v\n", backupID, err)
+			report.Errors = append(report.Errors, fmt.Sprintf("Error discovering resources: %v", err))
+		}
+		kinds = nil
+		for i := range discovered {
+			kinds = append(kinds, discovered[i].Kind)
+			resources[discovered[i].Kind] = &discovered[i].Resource
+		}
+		// Discovery only covers namespaced resources, the volumes bound to the
+		// claims and the namespaces themselves are backed up as in typed mode
+		kinds = append(kinds, PV, Namespace)
+	}
+	kinds, omittedKinds := getEffectiveKinds(kinds, spec.IncludedKinds, spec.ExcludedKinds)
+	for _, kind := range kinds {
+		updateTaskProgress(taskID, kind, Pending)
+	}
+
+	// Cluster-scoped kinds are backed up once the namespaced objects referring
+	// to them are stored
+	var namespacedKinds, clusterScopedKinds []ResourceKind
+	for _, kind := range kinds {
+		report.Kinds[kind] = &KindReport{}
+		if isClusterScopedKind(kind) {
+			clusterScopedKinds = append(clusterScopedKinds, kind)
+		} else {
+			namespacedKinds = append(namespacedKinds, kind)
+		}
+	}
+
+	// The pre-backup hooks quiesce the application, e.g. lock its tables, and
+	// the post-backup hooks always run to undo them, even when the backup is
+	// aborted or times out
+	hooksSucceeded := runBackupHooks(ctx, &report, app, PreBackupHook)
+	if !hooksSucceeded {
+		namespacedKinds, clusterScopedKinds = nil, nil
+		for _, kind := range kinds {
+			updateTaskProgress(taskID, kind, Failed)
+		}
+	}
+
+	for _, resource := range namespacedKinds {
+		wg.Add(1)
+		backupChan := BackupJob{
+			Kind:          resource,
+			Resource:      resources[resource],
+			BackupID:      backupID,
+			TaskID:        taskID,
+			Namespaces:    namespaces,
+			ListOptions:   listOptions,
+			ExcludedNames: spec.ExcludedNames,
+			SanitizeRules: spec.SanitizeRules,
+			Encryption:    spec.Encryption,
+			DataKey:       spec.DataKey,
+			Ctx:           ctx,
+			Wg:            wg,
+			Report:        report.Kinds[resource],
+		}
+		BackUpWorkerPool <- backupChan
+	}
+	wg.Wait()
+
+	// Objects referenced by the selected workloads may not match the selectors themselves
+	if listOptions.LabelSelector != "" || listOptions.FieldSelector != "" {
+		for _, namespace := range namespaces {
+			backupDependencies(ctx, backupID, namespace, listOptions, spec, &report)
+		}
+	}
+
+	if !runBackupHooks(context.Background(), &report, app, PostBackupHook) {
+		hooksSucceeded = false
+	}
+
+	for _, resource := range clusterScopedKinds {
+		wg.Add(1)
+		BackUpWorkerPool <- BackupJob{
+			Kind:          resource,
+			BackupID:      backupID,
+			TaskID:        taskID,
+			Namespaces:    namespaces,
+			ExcludedNames: spec.ExcludedNames,
+			SanitizeRules: spec.SanitizeRules,
+			Encryption:    spec.Encryption,
+			DataKey:       spec.DataKey,
+			Ctx:           ctx,
+			Wg:            wg,
+			Report:        report.Kinds[resource],
+		}
+	}
+	wg.Wait()
+
+	// The objects listed after the task timed out are missing from the backup
+	timedOut := ctx.Err() != nil
+	if timedOut {
+		report.Errors = append(report.Errors, "Backup timed out")
+	}
+	report.Status, report.FailedKinds = getBackupStatus(report)
+	if !hooksSucceeded || timedOut {
+		report.Status = BackupFailed
+	}
+	if err := storeBackupReport(report); err != nil {
+		fmt.Printf("[Backup] Error storing report of backup %s: %v\n", backupID, err)
+	}
+	if err := storeBackupManifest(report, app, spec, omittedKinds, startTime); err != nil {
+		fmt.Printf("[Backup] Error storing manifest of backup %s: %v\n", backupID, err)
+	}
+
+	backupResponse := getBackUpResponse(appID, backupID, "Backup created successfully")
+	backupResponse.TaskID = taskID
+	backupResponse.Status = report.Status
+	backupResponse.FailedKinds = report.FailedKinds
+	switch report.Status {
+	case BackupPartiallyFailed:
+		if len(report.FailedKinds) > 0 {
+			backupResponse.Message = fmt.Sprintf("Backup partially failed for %s", joinKinds(report.FailedKinds))
+		} else {
+			backupResponse.Message = fmt.Sprintf("Backup partially failed: %s", strings.Join(report.Errors, ", "))
+		}
+	case BackupFailed:
+		backupResponse.Message = "Backup failed"
+	}
+	setTaskResult(taskID, &backupResponse)
+	if report.Status == BackupFailed {
+		finishTask(taskID, Failed, backupResponse.Message)
+		return
+	}
+	finishTask(taskID, Completed, backupResponse.Message)
+}
+
+// getBackupStatus returns the status of the backup and the kinds that failed,
+// a kind being failed when any of its objects could not be backed up
+func getBackupStatus(report BackupReport) (BackupStatus, []ResourceKind) {
+	var failedKinds []ResourceKind
+	for _, kind := range getSortedKinds(report.Kinds) {
+		if len(report.Kinds[kind].Errors) > 0 {
+			failedKinds = append(failedKinds, kind)
+		}
+	}
+	switch {
+	case len(failedKinds) == 0 && len(report.Errors) == 0:
+		return BackupCompleted, nil
+	case len(failedKinds) == len(report.Kinds):
+		return BackupFailed, failedKinds
+	default:
+		return BackupPartiallyFailed, failedKinds
+	}
+}
+
+// getSortedKinds returns the kinds of the report in alphabetical order
+func getSortedKinds(kinds map[ResourceKind]*KindReport) []ResourceKind {
+	sortedKinds := make([]ResourceKind, 0, len(kinds))
+	for kind := range kinds {
+		sortedKinds = append(sortedKinds, kind)
+	}
+	sort.Slice(sortedKinds, func(i, j int) bool {
+		return sortedKinds[i] < sortedKinds[j]
+	})
+	return sortedKinds
+}
+
+// storeBackupReport writes the report into the backup directory
+func storeBackupReport(report BackupReport) error {
+	reportData, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding report to JSON: %v", err)
+	}
+	return store.Put(storage.Join(getBackupDir(report.BackupID), constants.BACKUP_REPORT_FILE), reportData)
+}
+
+// readBackupReport reads the report of the backup
+func readBackupReport(backupID string) (*BackupReport, error) {
+	reportData, err := store.Get(storage.Join(getBackupDir(backupID), constants.BACKUP_REPORT_FILE))
+	if err != nil {
+		return nil, err
+	}
+	var report BackupReport
+	if err := json.Unmarshal(reportData, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// joinKinds returns the kinds as a comma separated list
+func joinKinds(kinds []ResourceKind) string {
+	kindNames := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		kindNames = append(kindNames, string(kind))
+	}
+	return strings.Join(kindNames, ", ")
+}
+
 // BackUpWorkerPool is the pool of workers that back up resources
 var BackUpWorkerPool chan BackupJob
 
 // BackupJob represents a backup job
 type BackupJob struct {
-	Kind      ResourceKind
-	BackupID  string
-	Namespace string
-	Wg        *sync.WaitGroup
-	//completionStatusUpdateMutex *sync.Mutex
+	Kind ResourceKind
+	// Resource is the API resource of the kind in discovery mode, nil otherwise
+	Resource *schema.GroupVersionResource
+	BackupID string
+	TaskID   string
+	// Namespaces are the namespaces of the application, Namespace the one
+	// being backed up, empty for cluster-scoped kinds
+	Namespaces    []string
+	Namespace     string
+	ListOptions   metav1.ListOptions
+	ExcludedNames []string
+	SanitizeRules []SanitizeRule
+	// Encryption is the scope of the objects encrypted with DataKey
+	Encryption EncryptionScope
+	DataKey    []byte
+	Ctx        context.Context
+	Wg         *sync.WaitGroup
+	Report     *KindReport
 }
 
-// FetchAndStore fetches the resources and stores them in the backup directory
+// FetchAndStore fetches the resources of every namespace and stores them in the
+// backup directory. Every error is recorded in the job's report and returned.
 func (backupJob *BackupJob) FetchAndStore() []error {
 	// Fetch the backup data and store it in the backup directory
 	var err error
-	var errorList []error
 	var clientset *kubernetes.Clientset
 	clientset, err = orchestratorClient.GetClientFromKubeconfig("")
 	if err != nil {
-		panic(err.Error())
+		backupJob.recordError("", fmt.Errorf("Error creating kubernetes client: %v", err))
+		return backupJob.errors()
+	}
+	if isClusterScopedKind(backupJob.Kind) {
+		backupJob.fetchAndStoreNamespace(clientset)
+		return backupJob.errors()
+	}
+	for _, namespace := range backupJob.Namespaces {
+		// The copies share the report and run one after the other
+		namespaceJob := *backupJob
+		namespaceJob.Namespace = namespace
+		namespaceJob.fetchAndStoreNamespace(clientset)
+	}
+	return backupJob.errors()
+}
+
+// fetchAndStoreNamespace fetches the resources of the job's namespace and
+// stores them in the backup directory
+func (backupJob *BackupJob) fetchAndStoreNamespace(clientset *kubernetes.Clientset) {
+	if backupJob.Resource != nil {
+		backupJob.fetchAndStoreUnstructured()
+		return
 	}
 	switch backupJob.Kind {
 	case Pod:
-		list, err := clientset.CoreV1().Pods(backupJob.Namespace).List(context.TODO(), metav1.ListOptions{})
+		list, err := clientset.CoreV1().Pods(backupJob.Namespace).List(backupJob.Ctx, backupJob.ListOptions)
 		if err != nil {
-			panic(err.Error())
+			backupJob.recordError("", fmt.Errorf("Error listing %s: %v", backupJob.Kind, err))
+			break
 		}
 		// Iterate over fetched resources
 		for _, item := range list.Items {
 			// Convert unstructured object to YAML
 			item.APIVersion = "v1"
 			item.Kind = "Pod"
-			err = ParseAndStoreResource(item, item.GetName(), backupJob)
-			if err != nil {
-				errorList = append(errorList, err)
-			}
+			backupJob.storeResource(item, item.GetName())
 		}
 	case StatefulSet:
-		list, err := clientset.AppsV1().StatefulSets(backupJob.Namespace).List(context.TODO(), metav1.ListOptions{})
+		list, err := clientset.AppsV1().StatefulSets(backupJob.Namespace).List(backupJob.Ctx, backupJob.ListOptions)
 		if err != nil {
-			errorList = append(errorList, err)
+			backupJob.recordError("", fmt.Errorf("Error listing %s: %v", backupJob.Kind, err))
+			break
 		}
 		// Iterate over fetched resources
 		for _, item := range list.Items {
 			// Convert unstructured object to YAML
 			item.APIVersion = "apps/v1"
 			item.Kind = "StatefulSet"
-			err = ParseAndStoreResource(item, item.GetName(), backupJob)
-			if err != nil {
-				errorList = append(errorList, err)
-			}
+			backupJob.storeResource(item, item.GetName())
 		}
 	case Delpoyment:
-		list, err := clientset.AppsV1().Deployments(backupJob.Namespace).List(context.TODO(), metav1.ListOptions{})
+		list, err := clientset.AppsV1().Deployments(backupJob.Namespace).List(backupJob.Ctx, backupJob.ListOptions)
 		if err != nil {
-			errorList = append(errorList, err)
+			backupJob.recordError("", fmt.Errorf("Error listing %s: %v", backupJob.Kind, err))
+			break
 		}
 		// Iterate over fetched resources
 		for _, item := range list.Items {
 			// Convert unstructured object to YAML
 			item.APIVersion = "apps/v1"
 			item.Kind = "Deployment"
-			err = ParseAndStoreResource(item, item.GetName(), backupJob)
-			if err != nil {
-				errorList = append(errorList, err)
-			}
+			backupJob.storeResource(item, item.GetName())
 		}
 	case Service:
-		list, err := clientset.CoreV1().Services(backupJob.Namespace).List(context.TODO(), metav1.ListOptions{})
+		list, err := clientset.CoreV1().Services(backupJob.Namespace).List(backupJob.Ctx, backupJob.ListOptions)
 		if err != nil {
-			errorList = append(errorList, err)
+			backupJob.recordError("", fmt.Errorf("Error listing %s: %v", backupJob.Kind, err))
+			break
 		}
 		// Iterate over fetched resources
 		for _, item := range list.Items {
 			// Convert unstructured object to YAML
 			item.APIVersion = "v1"
 			item.Kind = "Service"
-			err = ParseAndStoreResource(item, item.GetName(), backupJob)
-			if err != nil {
-				errorList = append(errorList, err)
-			}
+			backupJob.storeResource(item, item.GetName())
 		}
 	case ConfigMap:
-		list, err := clientset.CoreV1().ConfigMaps(backupJob.Namespace).List(context.TODO(), metav1.ListOptions{})
+		list, err := clientset.CoreV1().ConfigMaps(backupJob.Namespace).List(backupJob.Ctx, backupJob.ListOptions)
 		if err != nil {
-			errorList = append(errorList, err)
+			backupJob.recordError("", fmt.Errorf("Error listing %s: %v", backupJob.Kind, err))
+			break
 		}
 		// Iterate over fetched resources
 		for _, item := range list.Items {
 			// Convert unstructured object to YAML
 			item.APIVersion = "v1"
 			item.Kind = "ConfigMap"
-			err = ParseAndStoreResource(item, item.GetName(), backupJob)
-			if err != nil {
-				errorList = append(errorList, err)
-			}
+			backupJob.storeResource(item, item.GetName())
 		}
 	case ReplicaSet:
-		list, err := clientset.AppsV1().ReplicaSets(backupJob.Namespace).List(context.TODO(), metav1.ListOptions{})
+		list, err := clientset.AppsV1().ReplicaSets(backupJob.Namespace).List(backupJob.Ctx, backupJob.ListOptions)
 		if err != nil {
-			errorList = append(errorList, err)
+			backupJob.recordError("", fmt.Errorf("Error listing %s: %v", backupJob.Kind, err))
+			break
 		}
 		// Iterate over fetched resources
 		for _, item := range list.Items {
 			// Convert unstructured object to YAML
 			item.APIVersion = "apps/v1"
 			item.Kind = "ReplicaSet"
-			err = ParseAndStoreResource(item, item.GetName(), backupJob)
-			if err != nil {
-				errorList = append(errorList, err)
-			}
+			backupJob.storeResource(item, item.GetName())
 		}
 	case PVC:
-		list, err := clientset.CoreV1().PersistentVolumeClaims(backupJob.Namespace).List(context.TODO(), metav1.ListOptions{})
+		list, err := clientset.CoreV1().PersistentVolumeClaims(backupJob.Namespace).List(backupJob.Ctx, backupJob.ListOptions)
 		if err != nil {
-			errorList = append(errorList, err)
+			backupJob.recordError("", fmt.Errorf("Error listing %s: %v", backupJob.Kind, err))
+			break
 		}
 		// Iterate over fetched resources
 		for _, item := range list.Items {
 			// Convert unstructured object to YAML
 			item.APIVersion = "v1"
 			item.Kind = "PersistentVolumeClaim"
-			err = ParseAndStoreResource(item, item.GetName(), backupJob)
-			if err != nil {
-				errorList = append(errorList, err)
-			}
+			backupJob.storeResource(item, item.GetName())
 		}
 	case PV:
-		list, err := clientset.CoreV1().PersistentVolumes().List(context.TODO(), metav1.ListOptions{})
+		// Only the volumes bound to the claims of the backup belong to the application
+		volumeNames, err := getBoundVolumeNames(backupJob.BackupID, backupJob.Namespaces, backupJob.DataKey)
 		if err != nil {
-			errorList = append(errorList, err)
+			backupJob.recordError("", fmt.Errorf("Error reading backed up %s: %v", PVC, err))
+			break
 		}
-		// Iterate over fetched resources
-		for _, item := range list.Items {
-			// Convert unstructured object to YAML
+		for _, volumeName := range volumeNames {
+			item, err := clientset.CoreV1().PersistentVolumes().Get(backupJob.Ctx, volumeName, metav1.GetOptions{})
+			if err != nil {
+				backupJob.recordError(volumeName, fmt.Errorf("Error fetching %s: %v", backupJob.Kind, err))
+				continue
+			}
 			item.APIVersion = "v1"
-			item.Kind = "PersistentVolumeClaim"
-			err = ParseAndStoreResource(item, item.GetName(), backupJob)
+			item.Kind = "PersistentVolume"
+			backupJob.storeResource(item, item.GetName())
+		}
+	case Namespace:
+		// The namespaces of the application carry settings such as pod security levels
+		for _, namespace := range backupJob.Namespaces {
+			item, err := clientset.CoreV1().Namespaces().Get(backupJob.Ctx, namespace, metav1.GetOptions{})
 			if err != nil {
-				errorList = append(errorList, err)
+				backupJob.recordError(namespace, fmt.Errorf("Error fetching %s: %v", backupJob.Kind, err))
+				continue
 			}
+			item.APIVersion = "v1"
+			item.Kind = "Namespace"
+			backupJob.storeResource(item, item.GetName())
 		}
 	case ServiceAccount:
-		list, err := clientset.CoreV1().ServiceAccounts(backupJob.Namespace).List(context.TODO(), metav1.ListOptions{})
+		list, err := clientset.CoreV1().ServiceAccounts(backupJob.Namespace).List(backupJob.Ctx, backupJob.ListOptions)
 		if err != nil {
-			errorList = append(errorList, err)
+			backupJob.recordError("", fmt.Errorf("Error listing %s: %v", backupJob.Kind, err))
+			break
 		}
 		// Iterate over fetched resources
 		for _, item := range list.Items {
 			// Convert unstructured object to YAML
 			item.APIVersion = "v1"
 			item.Kind = "ServiceAccount"
-			err = ParseAndStoreResource(item, item.GetName(), backupJob)
-			if err != nil {
-				errorList = append(errorList, err)
-			}
+			backupJob.storeResource(item, item.GetName())
 		}
 	case Secret:
-		list, err := clientset.CoreV1().Secrets(backupJob.Namespace).List(context.TODO(), metav1.ListOptions{})
+		list, err := clientset.CoreV1().Secrets(backupJob.Namespace).List(backupJob.Ctx, backupJob.ListOptions)
 		if err != nil {
-			errorList = append(errorList, err)
+			backupJob.recordError("", fmt.Errorf("Error listing %s: %v", backupJob.Kind, err))
+			break
 		}
 		// Iterate over fetched resources
 		for _, item := range list.Items {
 			// Convert unstructured object to YAML
 			item.APIVersion = "v1"
 			item.Kind = "Secret"
-			err = ParseAndStoreResource(item, item.GetName(), backupJob)
-			if err != nil {
-				errorList = append(errorList, err)
-			}
+			backupJob.storeResource(item, item.GetName())
 		}
 	default:
-		err := fmt.Errorf("Invalid resource type: %s", backupJob.Kind)
-		errorList = append(errorList, err)
+		backupJob.recordError("", fmt.Errorf("Invalid resource type: %s", backupJob.Kind))
 	}
-	return nil
+}
 
+// fetchAndStoreUnstructured lists the job's API resource through the dynamic
+// client and stores the objects as they are
+func (backupJob *BackupJob) fetchAndStoreUnstructured() {
+	dynamicClient, _, err := orchestratorClient.GetDynamicClientFromKubeconfig("")
+	if err != nil {
+		backupJob.recordError("", fmt.Errorf("Error creating dynamic client: %v", err))
+		return
+	}
+	list, err := dynamicClient.Resource(*backupJob.Resource).Namespace(backupJob.Namespace).List(backupJob.Ctx, backupJob.ListOptions)
+	if err != nil {
+		backupJob.recordError("", fmt.Errorf("Error listing %s: %v", backupJob.Kind, err))
+		return
+	}
+	for _, item := range list.Items {
+		backupJob.storeResource(item.Object, item.GetName())
+	}
 }
 
-//func (backupJob *BackupJob) UpdateStatus() error {
-//	backupJob.completionStatusUpdateMutex.Lock()
-//	defer backupJob.completionStatusUpdateMutex.Unlock()
-//	// Update the status of the backup job
-//	return nil
-//}
+// storeResource stores a single object and records the outcome in the job's report
+func (backupJob *BackupJob) storeResource(item interface{}, resourceName string) {
+	if isNameExcluded(backupJob.Kind, resourceName, backupJob.ExcludedNames) {
+		backupJob.Report.Excluded = append(backupJob.Report.Excluded, getObjectKey(backupJob.Namespace, resourceName))
+		return
+	}
+	if err := ParseAndStoreResource(item, resourceName, backupJob); err != nil {
+		backupJob.recordError(resourceName, err)
+		return
+	}
+	backupJob.Report.Count++
+}
+
+// recordError records an error in the job's report
+func (backupJob *BackupJob) recordError(resourceName string, err error) {
+	objectErr := ObjectError{Error: err.Error()}
+	if resourceName != "" {
+		objectErr.Name = getObjectKey(backupJob.Namespace, resourceName)
+	} else if backupJob.Namespace != "" {
+		objectErr.Error = fmt.Sprintf("%s: %v", backupJob.Namespace, err)
+	}
+	backupJob.Report.Errors = append(backupJob.Report.Errors, objectErr)
+}
+
+// errors returns the errors recorded in the job's report
+func (backupJob *BackupJob) errors() []error {
+	var errorList []error
+	for _, objectErr := range backupJob.Report.Errors {
+		errorList = append(errorList, fmt.Errorf("%s", objectErr.Error))
+	}
+	return errorList
+}
+
+// UpdateStatus updates the progress of the job's kind in the backup task
+func (backupJob *BackupJob) UpdateStatus(status TaskStatus) {
+	updateTaskProgress(backupJob.TaskID, backupJob.Kind, status)
+}
 
 // Initialize the backup worker pool
 func init() {
@@ -281,61 +873,56 @@ func init() {
 	for i := 0; i < constants.NUM_BACKUP_WORKERS; i++ {
 		go func(backupChanPool chan BackupJob) {
 			for job := range backupChanPool {
+				job.UpdateStatus(InProgress)
 				errs := job.FetchAndStore()
-				if errs != nil && len(errs) > 0 {
+				if len(errs) > 0 {
 					fmt.Printf("[Backup] Error fetching and storing %s: %v\n", job.Kind, errs)
+					job.UpdateStatus(Failed)
+				} else {
+					job.UpdateStatus(Completed)
 				}
 				job.Wg.Done()
-				// TODO: Asynchronously update the status of the backup job
-				//err := job.UpdateStatus()
-				//if err != nil {
-				//	fmt.Printf("Error updating status of %s: %v\n", job.Kind, err)
-				//}
 			}
 		}(BackUpWorkerPool)
 	}
 }
 
-// getAppNamespace returns the namespace of the application
-// TODO: Handle errors
-func getAppNamespace(appID string) string {
-	// check if appID exists in the database
-	filePath := fmt.Sprintf("%s/%s", constants.APPS_DIR, appID)
-	if !fileUtils.CheckDirectory(filePath) {
-		return ""
+// getAppListOptions returns the list options selecting the objects of the application
+func getAppListOptions(app Application) metav1.ListOptions {
+	return metav1.ListOptions{
+		LabelSelector: app.LabelSelector,
+		FieldSelector: app.FieldSelector,
 	}
-	// read the namespace from the file
-	appData, err := fileUtils.ReadFile(filePath)
-	if err != nil {
-		return ""
-	}
-	var app Application
-	err = json.Unmarshal(appData, &app)
-	if err != nil {
-		return ""
-	}
-	return app.Namespace
 }
 
 func ParseAndStoreResource(item interface{}, resourceName string, backupJob *BackupJob) error {
 	// Parse the resource and store it in the backup directory
-	itemYAML, err := yaml.Marshal(item)
+	itemJSON, err := json.Marshal(item)
 	if err != nil {
-		return fmt.Errorf("Error converting %s to YAML: %v\n", backupJob.Kind, err)
+		return fmt.Errorf("Error converting %s to JSON: %v", backupJob.Kind, err)
 	}
-	// Write YAML to file
-	dirPath := fmt.Sprintf("%s/%s/%s/", constants.BACKUPS_DIR, backupJob.BackupID, backupJob.Kind)
-	err = fileUtils.CreateDir(dirPath)
+	var obj map[string]interface{}
+	if err := json.Unmarshal(itemJSON, &obj); err != nil {
+		return fmt.Errorf("Error converting %s to JSON: %v", backupJob.Kind, err)
+	}
+	sanitizeObject(obj, backupJob.Kind, SanitizeBackup, backupJob.SanitizeRules)
+	itemYAML, err := yaml.Marshal(obj)
 	if err != nil {
-		return fmt.Errorf("Error creating directory: %v\n", err)
+		return fmt.Errorf("Error converting %s to YAML: %v", backupJob.Kind, err)
+	}
+	if isEncryptedKind(backupJob.Encryption, backupJob.Kind) {
+		if itemYAML, err = encryption.Seal(backupJob.DataKey, itemYAML); err != nil {
+			return fmt.Errorf("Error encrypting %s: %v", backupJob.Kind, err)
+		}
 	}
-	fileName := fmt.Sprintf("%s.yaml", resourceName)
-	err = fileUtils.WriteFile(dirPath+fileName, itemYAML)
+	// Write YAML to the store
+	key := storage.Join(getKindDir(backupJob.BackupID, backupJob.Namespace, backupJob.Kind), resourceName+".yaml")
+	err = store.Put(key, itemYAML)
 	if err != nil {
-		return fmt.Errorf("Error writing %s to file: %v\n", backupJob.Kind, err)
+		return fmt.Errorf("Error writing %s to store: %v", backupJob.Kind, err)
 	}
 
-	fmt.Printf("[Backup] Resource %s written to %s\n", resourceName, dirPath+fileName)
+	fmt.Printf("[Backup] Resource %s written to %s\n", resourceName, key)
 	return nil
 }
 
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"net/http"
+	"strings"
+)
+
+// defaultRenameSuffix is appended to the names of conflicting objects with the
+// rename policy when the request does not give a suffix
+const defaultRenameSuffix = "-restored"
+
+var errRestoreConflict = errors.New("object already exists")
+
+// liveFields are the fields of each kind that are kept from the existing
+// object when it is overwritten, because the cluster assigned them and they
+// cannot be changed
+var liveFields = map[ResourceKind][][]string{
+	Service: {{"spec", "clusterIP"}, {"spec", "clusterIPs"}},
+}
+
+// validateConflictPolicy checks the conflict policy and rename suffix of the
+// restore request
+func validateConflictPolicy(restoreReq RestoreRequest) error {
+	switch restoreReq.ConflictPolicy {
+	case "", ConflictSkip, ConflictOverwrite, ConflictFail, ConflictRename:
+	default:
+		return fmt.Errorf("Invalid conflict policy: %s", restoreReq.ConflictPolicy)
+	}
+	if strings.ContainsAny(restoreReq.RenameSuffix, "/ ") {
+		return fmt.Errorf("Invalid rename suffix: %q", restoreReq.RenameSuffix)
+	}
+	return nil
+}
+
+// createObject creates the object and resolves a conflict with an existing
+// object according to the conflict policy of the request. The outcome is
+// recorded in the restore response. It returns the object as it now is in the
+// cluster, or nil if it was not restored.
+func (job *restoreJob) createObject(resourceClient dynamic.ResourceInterface, kind ResourceKind, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	if job.Request.DryRun {
+		return job.planObject(resourceClient, kind, obj)
+	}
+	name := obj.GetName()
+	key := getObjectKey(obj.GetNamespace(), name)
+	created, err := resourceClient.Create(context.Background(), obj, metav1.CreateOptions{})
+	if err == nil {
+		job.Response.Created = appendName(job.Response.Created, kind, key)
+		job.CreatedObjects = append(job.CreatedObjects, restoredObject{Kind: kind, Namespace: obj.GetNamespace(), Name: name, UID: created.GetUID(), Client: resourceClient})
+		return created, nil
+	}
+	if !k8serrors.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("error creating %s %s: %v", kind, key, err)
+	}
+
+	switch job.Request.ConflictPolicy {
+	case ConflictOverwrite:
+		existing, err := resourceClient.Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error fetching existing %s %s: %v", kind, key, err)
+		}
+		setLiveFields(obj, existing, kind)
+		updated, err := resourceClient.Update(context.Background(), obj, metav1.UpdateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error updating %s %s: %v", kind, key, err)
+		}
+		job.Response.Updated = appendName(job.Response.Updated, kind, key)
+		return updated, nil
+	case ConflictFail:
+		return nil, fmt.Errorf("%s %s: %w", kind, key, errRestoreConflict)
+	case ConflictRename:
+		suffix := job.Request.RenameSuffix
+		if suffix == "" {
+			suffix = defaultRenameSuffix
+		}
+		obj.SetName(name + suffix)
+		created, err := resourceClient.Create(context.Background(), obj, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error creating %s %s as %s: %v", kind, key, obj.GetName(), err)
+		}
+		if job.Response.Renamed == nil {
+			job.Response.Renamed = make(map[ResourceKind]map[string]string)
+		}
+		if job.Response.Renamed[kind] == nil {
+			job.Response.Renamed[kind] = make(map[string]string)
+		}
+		job.Response.Renamed[kind][key] = obj.GetName()
+		job.CreatedObjects = append(job.CreatedObjects, restoredObject{Kind: kind, Namespace: obj.GetNamespace(), Name: obj.GetName(), UID: created.GetUID(), Client: resourceClient})
+		return created, nil
+	default:
+		// The existing object is returned so that the restored objects it
+		// owns keep it as their owner
+		existing, err := resourceClient.Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error fetching existing %s %s: %v", kind, key, err)
+		}
+		job.Response.Skipped = appendName(job.Response.Skipped, kind, key)
+		return existing, nil
+	}
+}
+
+// setLiveFields prepares the object to overwrite the existing one, keeping
+// its resource version and the fields that cannot be changed
+func setLiveFields(obj, existing *unstructured.Unstructured, kind ResourceKind) {
+	obj.SetResourceVersion(existing.GetResourceVersion())
+	for _, field := range liveFields[kind] {
+		if value, found, _ := unstructured.NestedFieldNoCopy(existing.Object, field...); found {
+			unstructured.SetNestedField(obj.Object, value, field...)
+		}
+	}
+}
+
+// getRestoreStatusCode maps restore errors to HTTP status codes
+func getRestoreStatusCode(err error) int {
+	if errors.Is(err, errRestoreConflict) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, errTransformFailed) || errors.Is(err, errDecryptionFailed) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/storage"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"github.com/arzzon/app-backup-restore/internal/utils/orchestratorClient"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// podDependencies holds the names of the objects referenced by pod specs
+type podDependencies map[ResourceKind]map[string]bool
+
+func (deps podDependencies) add(kind ResourceKind, name string) {
+	if name == "" {
+		return
+	}
+	if deps[kind] == nil {
+		deps[kind] = make(map[string]bool)
+	}
+	deps[kind][name] = true
+}
+
+// backupDependencies backs up the ConfigMaps, Secrets, PVCs and ServiceAccounts
+// used by the selected workloads which the selectors did not match themselves.
+// The outcome is recorded in the report of each kind, and a failure to collect
+// the dependencies in the errors of the backup.
+func backupDependencies(ctx context.Context, backupID, namespace string, listOptions metav1.ListOptions, spec backupSpec, report *BackupReport) {
+	clientset, err := orchestratorClient.GetClientFromKubeconfig("")
+	if err != nil {
+		fmt.Printf("[Backup] Error creating kubernetes client for dependencies: %v\n", err)
+		report.Errors = append(report.Errors, fmt.Sprintf("Error creating kubernetes client for dependencies of %s: %v", namespace, err))
+		return
+	}
+	deps, err := getPodDependencies(ctx, clientset, namespace, listOptions)
+	if err != nil {
+		fmt.Printf("[Backup] Error collecting dependencies of %s: %v\n", backupID, err)
+		// The dependencies collected from the workloads listed are still backed up
+		report.Errors = append(report.Errors, fmt.Sprintf("Error collecting dependencies in %s: %v", namespace, err))
+	}
+
+	for _, kind := range []ResourceKind{ConfigMap, Secret, PVC, ServiceAccount} {
+		kindReport, ok := report.Kinds[kind]
+		if !ok {
+			continue
+		}
+		backupJob := &BackupJob{
+			Kind:          kind,
+			BackupID:      backupID,
+			Namespace:     namespace,
+			ExcludedNames: spec.ExcludedNames,
+			SanitizeRules: spec.SanitizeRules,
+			Encryption:    spec.Encryption,
+			DataKey:       spec.DataKey,
+			Ctx:           ctx,
+			Report:        kindReport,
+		}
+		for name := range deps[kind] {
+			if isNameExcluded(kind, name, spec.ExcludedNames) || storage.Exists(store, storage.Join(getKindDir(backupID, namespace, kind), name+".yaml")) {
+				continue
+			}
+			item, err := getDependency(ctx, clientset, namespace, kind, name)
+			if errors.IsNotFound(err) {
+				// References may be optional, nothing to back up
+				fmt.Printf("[Backup] Dependency %s %s not found, skipping\n", kind, name)
+				continue
+			}
+			if err != nil {
+				backupJob.recordError(name, fmt.Errorf("Error fetching dependency: %v", err))
+				continue
+			}
+			backupJob.storeResource(item, name)
+		}
+	}
+}
+
+// getBoundVolumeNames returns the names of the PersistentVolumes bound to the
+// PVCs of the namespaces stored in the backup, decrypted with the data key
+func getBoundVolumeNames(backupID string, namespaces []string, dataKey []byte) ([]string, error) {
+	var files []string
+	for _, namespace := range namespaces {
+		namespaceFiles, err := store.List(getKindDir(backupID, namespace, PVC))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, namespaceFiles...)
+	}
+	var volumeNames []string
+	for _, file := range files {
+		claimData, err := readBackupFile(file, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		var claim v1.PersistentVolumeClaim
+		if err := yaml.Unmarshal(claimData, &claim); err != nil {
+			return nil, fmt.Errorf("error decoding %s: %v", file, err)
+		}
+		if claim.Spec.VolumeName != "" {
+			volumeNames = append(volumeNames, claim.Spec.VolumeName)
+		}
+	}
+	return volumeNames, nil
+}
+
+// getDependency fetches a single dependency with its type meta set
+func getDependency(ctx context.Context, clientset *kubernetes.Clientset, namespace string, kind ResourceKind, name string) (interface{}, error) {
+	switch kind {
+	case ConfigMap:
+		item, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		item.APIVersion = "v1"
+		item.Kind = "ConfigMap"
+		return item, nil
+	case Secret:
+		item, err := clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		item.APIVersion = "v1"
+		item.Kind = "Secret"
+		return item, nil
+	case PVC:
+		item, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		item.APIVersion = "v1"
+		item.Kind = "PersistentVolumeClaim"
+		return item, nil
+	case ServiceAccount:
+		item, err := clientset.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		item.APIVersion = "v1"
+		item.Kind = "ServiceAccount"
+		return item, nil
+	default:
+		return nil, fmt.Errorf("Invalid dependency type: %s", kind)
+	}
+}
+
+// getPodDependencies collects the objects referenced by the pod specs of the
+// selected Pods, Deployments, StatefulSets and ReplicaSets
+func getPodDependencies(ctx context.Context, clientset *kubernetes.Clientset, namespace string, listOptions metav1.ListOptions) (podDependencies, error) {
+	deps := make(podDependencies)
+	var errorList []error
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, listOptions)
+	if err != nil {
+		errorList = append(errorList, err)
+	} else {
+		for _, item := range pods.Items {
+			addPodSpecDependencies(deps, item.Spec)
+		}
+	}
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, listOptions)
+	if err != nil {
+		errorList = append(errorList, err)
+	} else {
+		for _, item := range deployments.Items {
+			addPodSpecDependencies(deps, item.Spec.Template.Spec)
+		}
+	}
+	statefulSets, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, listOptions)
+	if err != nil {
+		errorList = append(errorList, err)
+	} else {
+		for _, item := range statefulSets.Items {
+			addPodSpecDependencies(deps, item.Spec.Template.Spec)
+		}
+	}
+	replicaSets, err := clientset.AppsV1().ReplicaSets(namespace).List(ctx, listOptions)
+	if err != nil {
+		errorList = append(errorList, err)
+	} else {
+		for _, item := range replicaSets.Items {
+			addPodSpecDependencies(deps, item.Spec.Template.Spec)
+		}
+	}
+
+	if len(errorList) > 0 {
+		return deps, fmt.Errorf("%v", errorList)
+	}
+	return deps, nil
+}
+
+// addPodSpecDependencies adds the objects mounted or referenced by the pod spec
+func addPodSpecDependencies(deps podDependencies, spec v1.PodSpec) {
+	if spec.ServiceAccountName != "" {
+		deps.add(ServiceAccount, spec.ServiceAccountName)
+	} else {
+		deps.add(ServiceAccount, "default")
+	}
+	for _, secret := range spec.ImagePullSecrets {
+		deps.add(Secret, secret.Name)
+	}
+	for _, volume := range spec.Volumes {
+		if volume.ConfigMap != nil {
+			deps.add(ConfigMap, volume.ConfigMap.Name)
+		}
+		if volume.Secret != nil {
+			deps.add(Secret, volume.Secret.SecretName)
+		}
+		if volume.PersistentVolumeClaim != nil {
+			deps.add(PVC, volume.PersistentVolumeClaim.ClaimName)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil {
+					deps.add(ConfigMap, source.ConfigMap.Name)
+				}
+				if source.Secret != nil {
+					deps.add(Secret, source.Secret.Name)
+				}
+			}
+		}
+	}
+
+	containers := append([]v1.Container{}, spec.InitContainers...)
+	containers = append(containers, spec.Containers...)
+	for _, container := range containers {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.ConfigMapRef != nil {
+				deps.add(ConfigMap, envFrom.ConfigMapRef.Name)
+			}
+			if envFrom.SecretRef != nil {
+				deps.add(Secret, envFrom.SecretRef.Name)
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				deps.add(ConfigMap, env.ValueFrom.ConfigMapKeyRef.Name)
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				deps.add(Secret, env.ValueFrom.SecretKeyRef.Name)
+			}
+		}
+	}
+}
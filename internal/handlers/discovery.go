@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"github.com/arzzon/app-backup-restore/internal/utils/orchestratorClient"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"sort"
+	"strings"
+)
+
+// typedKindGVKs maps the resource kinds of the typed backup to their group version kind
+var typedKindGVKs = map[ResourceKind]schema.GroupVersionKind{
+	Pod:            {Version: "v1", Kind: "Pod"},
+	Delpoyment:     {Group: "apps", Version: "v1", Kind: "Deployment"},
+	ReplicaSet:     {Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+	StatefulSet:    {Group: "apps", Version: "v1", Kind: "StatefulSet"},
+	Service:        {Version: "v1", Kind: "Service"},
+	Secret:         {Version: "v1", Kind: "Secret"},
+	ConfigMap:      {Version: "v1", Kind: "ConfigMap"},
+	PV:             {Version: "v1", Kind: "PersistentVolume"},
+	PVC:            {Version: "v1", Kind: "PersistentVolumeClaim"},
+	ServiceAccount: {Version: "v1", Kind: "ServiceAccount"},
+	Namespace:      {Version: "v1", Kind: "Namespace"},
+}
+
+// clusterScopedKinds are the kinds of the typed backup which are not namespaced
+var clusterScopedKinds = map[ResourceKind]bool{
+	PV:        true,
+	Namespace: true,
+}
+
+// isClusterScopedKind checks if the objects of the kind are cluster-scoped
+func isClusterScopedKind(kind ResourceKind) bool {
+	return clusterScopedKinds[kind]
+}
+
+// discoveryExcludedResources are the resources left out of a discovery backup
+// because they are events or are regenerated by the cluster, as group/resource
+var discoveryExcludedResources = map[string]bool{
+	"/events":                         true,
+	"events.k8s.io/events":            true,
+	"/endpoints":                      true,
+	"discovery.k8s.io/endpointslices": true,
+}
+
+// discoveredResource is a namespaced API resource found through discovery
+type discoveredResource struct {
+	Kind     ResourceKind
+	Resource schema.GroupVersionResource
+}
+
+// discoverResources returns the preferred version of every namespaced API
+// resource that can be listed and created. When some API groups cannot be
+// discovered the resources of the other groups are returned with the error.
+func discoverResources() ([]discoveredResource, error) {
+	clientset, err := orchestratorClient.GetClientFromKubeconfig("")
+	if err != nil {
+		return nil, err
+	}
+	resourceLists, err := clientset.Discovery().ServerPreferredNamespacedResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, err
+	}
+
+	var resources []discoveredResource
+	for _, resourceList := range resourceLists {
+		groupVersion, parseErr := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if parseErr != nil {
+			continue
+		}
+		for _, apiResource := range resourceList.APIResources {
+			// Skip subresources such as pods/log
+			if strings.Contains(apiResource.Name, "/") {
+				continue
+			}
+			if !hasVerbs(apiResource, "list", "get", "create") {
+				continue
+			}
+			if discoveryExcludedResources[groupVersion.Group+"/"+apiResource.Name] {
+				continue
+			}
+			resources = append(resources, discoveredResource{
+				Kind:     getResourceKind(groupVersion.WithKind(apiResource.Kind)),
+				Resource: groupVersion.WithResource(apiResource.Name),
+			})
+		}
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Kind < resources[j].Kind
+	})
+	return resources, err
+}
+
+// getResourceKind returns the resource kind under which objects of the group
+// version kind are stored. Kinds of the typed backup keep their name, other
+// kinds are qualified with their API group, e.g. Ingress.networking.k8s.io.
+func getResourceKind(gvk schema.GroupVersionKind) ResourceKind {
+	for kind, typedGVK := range typedKindGVKs {
+		if typedGVK.GroupKind() == gvk.GroupKind() {
+			return kind
+		}
+	}
+	if gvk.Group == "" {
+		return ResourceKind(gvk.Kind)
+	}
+	return ResourceKind(fmt.Sprintf("%s.%s", gvk.Kind, gvk.Group))
+}
+
+// hasVerbs checks if the API resource supports all the verbs
+func hasVerbs(apiResource metav1.APIResource, verbs ...string) bool {
+	supported := make(map[string]bool, len(apiResource.Verbs))
+	for _, verb := range apiResource.Verbs {
+		supported[verb] = true
+	}
+	for _, verb := range verbs {
+		if !supported[verb] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"reflect"
+	"sort"
+)
+
+// diffIgnoredFields are left out of the diff as the server sets them on every write
+var diffIgnoredFields = [][]string{
+	{"metadata", "resourceVersion"},
+	{"metadata", "managedFields"},
+	{"metadata", "generation"},
+	{"metadata", "uid"},
+	{"metadata", "creationTimestamp"},
+	{"status"},
+}
+
+// planObject runs the object through a server-side dry run and records in the
+// plan whether it is new, changes an existing object or would be rejected. The
+// objects of a namespace the restore would create are new, the API server
+// rejecting any object of a namespace that does not exist.
+func (job *restoreJob) planObject(resourceClient dynamic.ResourceInterface, kind ResourceKind, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	plan := job.Response.Plan
+	name := obj.GetName()
+	key := getObjectKey(obj.GetNamespace(), name)
+	if job.PlannedNamespaces[obj.GetNamespace()] {
+		plan.New = appendName(plan.New, kind, key)
+		return obj, nil
+	}
+	dryRunObj, err := resourceClient.Create(context.Background(), obj.DeepCopy(), metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	if err == nil {
+		plan.New = appendName(plan.New, kind, key)
+		return dryRunObj, nil
+	}
+	if !k8serrors.IsAlreadyExists(err) {
+		plan.Rejected = appendObjectError(plan.Rejected, kind, ObjectError{Name: key, Error: err.Error()})
+		return nil, nil
+	}
+
+	existing, err := resourceClient.Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching existing %s %s: %v", kind, key, err)
+	}
+	update := obj.DeepCopy()
+	setLiveFields(update, existing, kind)
+	dryRunObj, err = resourceClient.Update(context.Background(), update, metav1.UpdateOptions{DryRun: []string{metav1.DryRunAll}})
+	if err != nil {
+		plan.Rejected = appendObjectError(plan.Rejected, kind, ObjectError{Name: key, Error: err.Error()})
+		return nil, nil
+	}
+
+	// Both sides went through the API server, so defaults are set on both
+	fields := diffObjects(withoutIgnoredFields(existing.Object), withoutIgnoredFields(dryRunObj.Object), "")
+	if len(fields) == 0 {
+		plan.Unchanged = appendName(plan.Unchanged, kind, key)
+		return existing, nil
+	}
+	if plan.Changed == nil {
+		plan.Changed = make(map[ResourceKind][]ObjectDiff)
+	}
+	plan.Changed[kind] = append(plan.Changed[kind], ObjectDiff{Name: key, Fields: fields})
+	return existing, nil
+}
+
+// withoutIgnoredFields returns a copy of the object without the fields the
+// server sets on every write
+func withoutIgnoredFields(obj map[string]interface{}) map[string]interface{} {
+	copied := runtime.DeepCopyJSON(obj)
+	for _, field := range diffIgnoredFields {
+		unstructured.RemoveNestedField(copied, field...)
+	}
+	return copied
+}
+
+// diffObjects returns the fields that differ between the live and backed up
+// values, as dot separated paths. Lists of the same length are compared item
+// by item, other lists as a whole.
+func diffObjects(live, backup interface{}, path string) []FieldDiff {
+	liveMap, liveIsMap := live.(map[string]interface{})
+	backupMap, backupIsMap := backup.(map[string]interface{})
+	if liveIsMap && backupIsMap {
+		keys := make(map[string]bool)
+		for key := range liveMap {
+			keys[key] = true
+		}
+		for key := range backupMap {
+			keys[key] = true
+		}
+		sortedKeys := make([]string, 0, len(keys))
+		for key := range keys {
+			sortedKeys = append(sortedKeys, key)
+		}
+		sort.Strings(sortedKeys)
+
+		var fields []FieldDiff
+		for _, key := range sortedKeys {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			fields = append(fields, diffObjects(liveMap[key], backupMap[key], fieldPath)...)
+		}
+		return fields
+	}
+
+	liveList, liveIsList := live.([]interface{})
+	backupList, backupIsList := backup.([]interface{})
+	if liveIsList && backupIsList && len(liveList) == len(backupList) {
+		var fields []FieldDiff
+		for i := range liveList {
+			fields = append(fields, diffObjects(liveList[i], backupList[i], fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return fields
+	}
+
+	if reflect.DeepEqual(live, backup) {
+		return nil
+	}
+	return []FieldDiff{{Path: path, Live: live, Backup: backup}}
+}
+
+// appendName adds the name to the names of the kind
+func appendName(names map[ResourceKind][]string, kind ResourceKind, name string) map[ResourceKind][]string {
+	if names == nil {
+		names = make(map[ResourceKind][]string)
+	}
+	names[kind] = append(names[kind], name)
+	return names
+}
+
+// appendObjectError adds the error to the errors of the kind
+func appendObjectError(objectErrors map[ResourceKind][]ObjectError, kind ResourceKind, objectErr ObjectError) map[ResourceKind][]ObjectError {
+	if objectErrors == nil {
+		objectErrors = make(map[ResourceKind][]ObjectError)
+	}
+	objectErrors[kind] = append(objectErrors[kind], objectErr)
+	return objectErrors
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"reflect"
+	"testing"
+)
+
+func TestDiffObjects(t *testing.T) {
+	live := `
+apiVersion: apps/v1
+kind: Deployment
+metadata: {name: web, namespace: ns1, uid: u2, resourceVersion: "12", generation: 3, labels: {app: web, tier: front}}
+spec:
+  replicas: 2
+  template:
+    spec:
+      containers: [{name: c, image: "nginx:1.25", args: [a, b]}]
+status: {readyReplicas: 2}`
+	backup := `
+apiVersion: apps/v1
+kind: Deployment
+metadata: {name: web, namespace: ns1, uid: u1, resourceVersion: "7", generation: 1, labels: {app: web}}
+spec:
+  replicas: 3
+  paused: true
+  template:
+    spec:
+      containers: [{name: c, image: "nginx:1.24", args: [a]}]
+status: {readyReplicas: 0}`
+	liveObj, err := parseObject([]byte(live))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backupObj, err := parseObject([]byte(backup))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := diffObjects(withoutIgnoredFields(liveObj.Object), withoutIgnoredFields(backupObj.Object), "")
+	want := []FieldDiff{
+		// A field removed from the live object
+		{Path: "metadata.labels.tier", Live: "front"},
+		// A field added by the backup
+		{Path: "spec.paused", Backup: true},
+		{Path: "spec.replicas", Live: int64(2), Backup: int64(3)},
+		// Lists of different lengths are compared as a whole, the items of
+		// lists of the same length one by one
+		{Path: "spec.template.spec.containers[0].args", Live: []interface{}{"a", "b"}, Backup: []interface{}{"a"}},
+		{Path: "spec.template.spec.containers[0].image", Live: "nginx:1.25", Backup: "nginx:1.24"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffObjects =\n%#v\nwant\n%#v", got, want)
+	}
+
+	if fields := diffObjects(withoutIgnoredFields(liveObj.Object), withoutIgnoredFields(liveObj.DeepCopy().Object), ""); len(fields) != 0 {
+		t.Errorf("diff of identical objects = %v, want none", fields)
+	}
+}
+
+func TestPlanObjectInPlannedNamespace(t *testing.T) {
+	obj, err := parseObject([]byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata: {name: cm1, namespace: ns2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &restoreJob{
+		Response:          &RestoreResponse{Plan: &RestorePlan{}},
+		PlannedNamespaces: map[string]bool{"ns2": true},
+	}
+	// The namespace does not exist yet, so the API server must not be asked:
+	// a nil client would panic
+	planned, err := job.planObject(nil, ConfigMap, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if planned != obj {
+		t.Errorf("planObject returned %v, want the object itself", planned)
+	}
+	if want := map[ResourceKind][]string{ConfigMap: {"ns2/cm1"}}; !reflect.DeepEqual(job.Response.Plan.New, want) {
+		t.Errorf("plan.New = %v, want %v", job.Response.Plan.New, want)
+	}
+}
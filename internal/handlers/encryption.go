@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/constants"
+	"github.com/arzzon/app-backup-restore/internal/encryption"
+	"github.com/arzzon/app-backup-restore/internal/storage"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"net/http"
+	"sync"
+)
+
+// keyring holds the master key wrapping the data keys of the backups, nil when
+// no master key is configured
+var keyring *encryption.Keyring
+
+// rotationLock is held for writing while the master key is rotated, and for
+// reading while a manifest wraps a data key, so that no data key is left
+// wrapped by a key the next rotation forgets
+var rotationLock sync.RWMutex
+
+var errDecryptionFailed = errors.New("backup cannot be decrypted")
+
+// SetKeyring sets the master keys used to encrypt the backups
+func SetKeyring(masterKeys *encryption.Keyring) {
+	keyring = masterKeys
+}
+
+// EncryptionHandler handles the master key requests
+func EncryptionHandler(w http.ResponseWriter, r *http.Request) {
+	if getPathID(r.URL.Path, "/encryption/") != "rotate" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		RotateMasterKey(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RotateMasterKey replaces the master key and wraps the data key of every
+// encrypted backup with the new key. The encrypted objects are left as they
+// are, only the manifests are rewritten. Retired keys are kept as long as a
+// manifest refers to them, so a backup that could not be wrapped again stays
+// readable and is wrapped by a later rotation.
+func RotateMasterKey(w http.ResponseWriter, r *http.Request) {
+	if keyring == nil {
+		http.Error(w, "No master key is configured", http.StatusConflict)
+		return
+	}
+	rotationLock.Lock()
+	defer rotationLock.Unlock()
+	inUse, err := getWrappingKeyIDs()
+	if err != nil {
+		fmt.Printf("[Encryption] Error reading backup manifests: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	keyID, err := keyring.Rotate(inUse)
+	if err != nil {
+		fmt.Printf("[Encryption] Error rotating master key: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("[Encryption] Master key rotated, new key %s\n", keyID)
+
+	response := KeyRotationResponse{MasterKeyID: keyID, Rewrapped: []string{}}
+	backupIDs, err := storage.ListChildren(store, constants.BACKUPS_DIR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, backupID := range backupIDs {
+		rewrapped, err := rewrapBackupKey(backupID)
+		if err != nil {
+			fmt.Printf("[Encryption] Error wrapping data key of backup %s: %v\n", backupID, err)
+			if response.Errors == nil {
+				response.Errors = make(map[string]string)
+			}
+			response.Errors[backupID] = err.Error()
+			continue
+		}
+		if rewrapped {
+			response.Rewrapped = append(response.Rewrapped, backupID)
+		}
+	}
+	writeJSONResponse(w, http.StatusOK, response)
+}
+
+// getWrappingKeyIDs returns the IDs of the master keys wrapping the data keys
+// of the backups. A manifest that cannot be read fails the lookup, as the key
+// it refers to would be forgotten otherwise.
+func getWrappingKeyIDs() (map[string]bool, error) {
+	backupIDs, err := storage.ListChildren(store, constants.BACKUPS_DIR)
+	if err != nil {
+		return nil, err
+	}
+	keyIDs := make(map[string]bool)
+	for _, backupID := range backupIDs {
+		// Backups still in progress have no manifest yet, their data key is
+		// wrapped once the rotation is over
+		if !storage.Exists(store, storage.Join(getBackupDir(backupID), constants.BACKUP_MANIFEST_FILE)) {
+			continue
+		}
+		manifest, err := readBackupManifest(backupID)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.Encryption != nil {
+			keyIDs[manifest.Encryption.MasterKeyID] = true
+		}
+	}
+	return keyIDs, nil
+}
+
+// rewrapBackupKey wraps the data key of the backup with the current master key.
+// It returns false for backups that are not encrypted, still in progress, or
+// already use the current key.
+func rewrapBackupKey(backupID string) (bool, error) {
+	if !storage.Exists(store, storage.Join(getBackupDir(backupID), constants.BACKUP_MANIFEST_FILE)) {
+		return false, nil
+	}
+	rewrapped := false
+	_, err := updateBackupManifest(backupID, func(manifest *BackupManifest) (bool, error) {
+		if manifest.Encryption == nil || manifest.Encryption.MasterKeyID == keyring.KeyID() {
+			return false, nil
+		}
+		dataKey, err := keyring.Unwrap(manifest.Encryption.MasterKeyID, manifest.Encryption.WrappedKey)
+		if err != nil {
+			return false, err
+		}
+		manifest.Encryption.MasterKeyID, manifest.Encryption.WrappedKey, err = keyring.Wrap(dataKey)
+		rewrapped = err == nil
+		return rewrapped, err
+	})
+	return rewrapped, err
+}
+
+// getEncryptionScope returns the objects of the application to encrypt:
+// Secrets by default when a master key is configured, nothing otherwise
+func getEncryptionScope(app Application) (EncryptionScope, error) {
+	if keyring == nil {
+		if app.Encryption != "" {
+			return "", errors.New("Application requires encryption but no master key is configured")
+		}
+		return "", nil
+	}
+	if app.Encryption == "" {
+		return EncryptSecrets, nil
+	}
+	return app.Encryption, nil
+}
+
+// validateEncryptionScope checks the encryption scope of an application
+func validateEncryptionScope(scope EncryptionScope) error {
+	if scope != "" && scope != EncryptSecrets && scope != EncryptAll {
+		return fmt.Errorf("Invalid encryption scope: %s", scope)
+	}
+	return nil
+}
+
+// isEncryptedKind checks if the objects of the kind are encrypted in the scope
+func isEncryptedKind(scope EncryptionScope, kind ResourceKind) bool {
+	return scope == EncryptAll || (scope == EncryptSecrets && kind == Secret)
+}
+
+// wrapBackupKey returns the encryption record of the manifest, with the data
+// key wrapped by the current master key
+func wrapBackupKey(scope EncryptionScope, dataKey []byte) (*BackupEncryption, error) {
+	keyID, wrapped, err := keyring.Wrap(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error wrapping data key: %v", err)
+	}
+	return &BackupEncryption{Scope: scope, MasterKeyID: keyID, WrappedKey: wrapped}, nil
+}
+
+// getBackupKey returns the data key of the backup, nil when it is not encrypted
+func getBackupKey(manifest *BackupManifest) ([]byte, error) {
+	if manifest.Encryption == nil {
+		return nil, nil
+	}
+	if keyring == nil {
+		return nil, fmt.Errorf("%w: no master key is configured", errDecryptionFailed)
+	}
+	dataKey, err := keyring.Unwrap(manifest.Encryption.MasterKeyID, manifest.Encryption.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errDecryptionFailed, err)
+	}
+	return dataKey, nil
+}
+
+// readBackupFile reads a YAML file of a backup, decrypting it with the data
+// key of the backup when it is encrypted
+func readBackupFile(key string, dataKey []byte) ([]byte, error) {
+	data, err := store.Get(key)
+	if err != nil || !encryption.IsSealed(data) {
+		return data, err
+	}
+	if dataKey == nil {
+		return nil, fmt.Errorf("%w: %s is encrypted but the backup has no data key", errDecryptionFailed, key)
+	}
+	data, err = encryption.Open(dataKey, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errDecryptionFailed, key, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"fmt"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"path"
+	"strings"
+)
+
+// getEffectiveKinds returns the candidate kinds left after applying the
+// included and excluded kinds, along with the candidates that were omitted
+func getEffectiveKinds(candidates, includedKinds, excludedKinds []ResourceKind) ([]ResourceKind, []ResourceKind) {
+	var kinds, omittedKinds []ResourceKind
+	for _, kind := range candidates {
+		included := len(includedKinds) == 0 || matchesAnyKind(kind, includedKinds)
+		if included && !matchesAnyKind(kind, excludedKinds) {
+			kinds = append(kinds, kind)
+		} else {
+			omittedKinds = append(omittedKinds, kind)
+		}
+	}
+	return kinds, omittedKinds
+}
+
+// matchesAnyKind checks if the kind matches any of the given kinds
+func matchesAnyKind(kind ResourceKind, kinds []ResourceKind) bool {
+	for _, other := range kinds {
+		if kindMatches(kind, string(other)) {
+			return true
+		}
+	}
+	return false
+}
+
+// kindMatches checks if the kind is referred to by name, either as the
+// resource kind itself (PVC, Ingress.networking.k8s.io) or by its plain kind
+// name (PersistentVolumeClaim, Ingress). Names are case-insensitive.
+func kindMatches(kind ResourceKind, name string) bool {
+	if strings.EqualFold(string(kind), name) {
+		return true
+	}
+	if gvk, ok := typedKindGVKs[kind]; ok {
+		return strings.EqualFold(gvk.Kind, name)
+	}
+	plainKind, _, _ := strings.Cut(string(kind), ".")
+	return strings.EqualFold(plainKind, name)
+}
+
+// isNameExcluded checks if the object matches any of the name patterns. A
+// pattern is a glob on the object name, optionally prefixed with a kind as in
+// Secret/default-token-*.
+func isNameExcluded(kind ResourceKind, name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if patternKind, namePattern, found := strings.Cut(pattern, "/"); found {
+			if !kindMatches(kind, patternKind) {
+				continue
+			}
+			pattern = namePattern
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNamePatterns checks that the name patterns are valid globs
+func validateNamePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, namePattern, found := strings.Cut(pattern, "/"); found {
+			pattern = namePattern
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid name pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"reflect"
+	"testing"
+)
+
+func TestGetEffectiveKinds(t *testing.T) {
+	candidates := []ResourceKind{ConfigMap, Secret, PVC, Delpoyment, "Ingress.networking.k8s.io"}
+	tests := []struct {
+		name        string
+		included    []ResourceKind
+		excluded    []ResourceKind
+		wantKinds   []ResourceKind
+		wantOmitted []ResourceKind
+	}{
+		{
+			name:      "empty include list keeps every kind",
+			wantKinds: candidates,
+		},
+		{
+			name:        "include list keeps only the kinds named",
+			included:    []ResourceKind{"configmap", "PersistentVolumeClaim"},
+			wantKinds:   []ResourceKind{ConfigMap, PVC},
+			wantOmitted: []ResourceKind{Secret, Delpoyment, "Ingress.networking.k8s.io"},
+		},
+		{
+			name:        "exclude wins over include",
+			included:    []ResourceKind{ConfigMap, Secret, "Ingress"},
+			excluded:    []ResourceKind{"Secret", "Ingress"},
+			wantKinds:   []ResourceKind{ConfigMap},
+			wantOmitted: []ResourceKind{Secret, PVC, Delpoyment, "Ingress.networking.k8s.io"},
+		},
+		{
+			name:        "exclude without include",
+			excluded:    []ResourceKind{"PVC"},
+			wantKinds:   []ResourceKind{ConfigMap, Secret, Delpoyment, "Ingress.networking.k8s.io"},
+			wantOmitted: []ResourceKind{PVC},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kinds, omitted := getEffectiveKinds(candidates, test.included, test.excluded)
+			if !reflect.DeepEqual(kinds, test.wantKinds) {
+				t.Errorf("kinds = %v, want %v", kinds, test.wantKinds)
+			}
+			if !reflect.DeepEqual(omitted, test.wantOmitted) {
+				t.Errorf("omitted kinds = %v, want %v", omitted, test.wantOmitted)
+			}
+		})
+	}
+}
+
+func TestKindMatches(t *testing.T) {
+	tests := []struct {
+		kind ResourceKind
+		name string
+		want bool
+	}{
+		{PVC, "PVC", true},
+		{PVC, "persistentvolumeclaim", true},
+		{Delpoyment, "Deployment", true},
+		{"Ingress.networking.k8s.io", "Ingress", true},
+		{"Ingress.networking.k8s.io", "ingress.networking.k8s.io", true},
+		{ConfigMap, "Secret", false},
+		{PV, "PersistentVolumeClaim", false},
+	}
+	for _, test := range tests {
+		if got := kindMatches(test.kind, test.name); got != test.want {
+			t.Errorf("kindMatches(%s, %s) = %v, want %v", test.kind, test.name, got, test.want)
+		}
+	}
+}
+
+func TestIsNameExcluded(t *testing.T) {
+	patterns := []string{"Secret/default-token-*", "*-tmp", "cm-?"}
+	tests := []struct {
+		name       string
+		kind       ResourceKind
+		objectName string
+		want       bool
+	}{
+		{"kind pattern matches", Secret, "default-token-abc", true},
+		{"kind pattern of another kind", ConfigMap, "default-token-abc", false},
+		{"kind pattern without match", Secret, "db-pass", false},
+		{"glob on any kind", ConfigMap, "cache-tmp", true},
+		{"single character glob", ConfigMap, "cm-1", true},
+		{"single character glob without match", ConfigMap, "cm-12", false},
+		{"no pattern matches", Delpoyment, "web", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isNameExcluded(test.kind, test.objectName, patterns); got != test.want {
+				t.Errorf("isNameExcluded(%s, %s) = %v, want %v", test.kind, test.objectName, got, test.want)
+			}
+		})
+	}
+	if isNameExcluded(Secret, "default-token-abc", nil) {
+		t.Errorf("isNameExcluded without patterns = true, want false")
+	}
+}
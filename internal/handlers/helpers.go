@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/arzzon/app-backup-restore/internal/storage"
+	"net/http"
+	"strings"
+)
+
+// store persists the applications, backups and transform profiles
+var store storage.Storage
+
+// SetStorage sets the storage backend used by the handlers
+func SetStorage(backend storage.Storage) {
+	store = backend
+}
+
+// getPathID returns the ID following the prefix in the request path, e.g. the
+// backup ID of /backup/<id>. It is empty when the path has no ID.
+func getPathID(path, prefix string) string {
+	return strings.Trim(strings.TrimPrefix(path, prefix), "/")
+}
+
+// isValidID checks that the ID can be safely used as a single path element in the store
+func isValidID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
+
+// writeJSONResponse encodes the response as JSON and writes it with the given status code
+func writeJSONResponse(w http.ResponseWriter, statusCode int, response interface{}) {
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(jsonResponse)
+}
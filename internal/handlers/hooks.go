@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/constants"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"github.com/arzzon/app-backup-restore/internal/utils/orchestratorClient"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+	"net/http"
+	"time"
+)
+
+// limitedBuffer keeps the first limit bytes written to it and drops the rest,
+// so that a verbose hook cannot bloat the backup report
+type limitedBuffer struct {
+	buffer    bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (buffer *limitedBuffer) Write(p []byte) (int, error) {
+	if room := buffer.limit - buffer.buffer.Len(); room < len(p) {
+		buffer.truncated = true
+		if room > 0 {
+			buffer.buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return buffer.buffer.Write(p)
+}
+
+func (buffer *limitedBuffer) String() string {
+	if buffer.truncated {
+		return buffer.buffer.String() + "\n[output truncated]"
+	}
+	return buffer.buffer.String()
+}
+
+// runBackupHooks runs the hooks of the phase in order and records their runs in
+// the report. It returns false once a hook with the fail policy fails, the
+// following hooks of the phase being skipped.
+func runBackupHooks(ctx context.Context, report *BackupReport, app Application, phase HookPhase) bool {
+	hooks := app.PreHooks
+	if phase == PostBackupHook {
+		hooks = app.PostHooks
+	}
+	if len(hooks) == 0 {
+		return true
+	}
+	config, err := orchestratorClient.GetConfigFromKubeconfig("")
+	var clientset *kubernetes.Clientset
+	if err == nil {
+		clientset, err = kubernetes.NewForConfig(config)
+	}
+
+	for _, hook := range hooks {
+		failed := false
+		for _, namespace := range getHookNamespaces(app, hook) {
+			var results []HookResult
+			if err != nil {
+				results = []HookResult{{Hook: hook.Name, Phase: phase, Namespace: namespace, StartTime: time.Now().UTC(),
+					Error: fmt.Sprintf("Error creating kubernetes client: %v", err)}}
+			} else {
+				results = runBackupHook(ctx, clientset, config, hook, phase, namespace)
+			}
+			for _, result := range results {
+				failed = failed || result.Error != ""
+			}
+			report.Hooks = append(report.Hooks, results...)
+		}
+		if failed && hook.OnError != HookContinue {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s-backup hook %s failed", phase, hook.Name))
+			return false
+		}
+	}
+	return true
+}
+
+// runBackupHook runs the hook in the running pods of the namespace matching
+// its selector. Finding no such pod fails the hook.
+func runBackupHook(ctx context.Context, clientset *kubernetes.Clientset, config *rest.Config, hook BackupHook, phase HookPhase, namespace string) []HookResult {
+	startTime := time.Now().UTC()
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: hook.PodSelector})
+	if err != nil {
+		return []HookResult{{Hook: hook.Name, Phase: phase, Namespace: namespace, StartTime: startTime,
+			Error: fmt.Sprintf("Error listing pods: %v", err)}}
+	}
+	var results []HookResult
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		results = append(results, execBackupHook(ctx, clientset, config, hook, phase, pod))
+	}
+	if len(results) == 0 {
+		return []HookResult{{Hook: hook.Name, Phase: phase, Namespace: namespace, StartTime: startTime,
+			Error: fmt.Sprintf("No running pod matches %s", hook.PodSelector)}}
+	}
+	return results
+}
+
+// execBackupHook runs the command of the hook in the pod through the pods/exec
+// subresource, within the timeout of the hook
+func execBackupHook(ctx context.Context, clientset *kubernetes.Clientset, config *rest.Config, hook BackupHook, phase HookPhase, pod v1.Pod) (result HookResult) {
+	result = HookResult{
+		Hook:      hook.Name,
+		Phase:     phase,
+		Namespace: pod.Namespace,
+		Pod:       pod.Name,
+		Container: hook.Container,
+		StartTime: time.Now().UTC(),
+	}
+	defer func() {
+		result.Duration = time.Since(result.StartTime).Round(time.Millisecond).String()
+	}()
+	if result.Container == "" {
+		result.Container = pod.Spec.Containers[0].Name
+	} else if !hasContainer(pod, result.Container) {
+		result.Error = fmt.Sprintf("Container %s not found in pod %s", result.Container, pod.Name)
+		return result
+	}
+
+	timeout := constants.HOOK_TIMEOUT * time.Second
+	if hook.TimeoutSeconds > 0 {
+		timeout = time.Duration(hook.TimeoutSeconds) * time.Second
+	}
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	request := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: result.Container,
+			Command:   hook.Command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	stdout := &limitedBuffer{limit: constants.HOOK_OUTPUT_LIMIT}
+	stderr := &limitedBuffer{limit: constants.HOOK_OUTPUT_LIMIT}
+	executor, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, request.URL())
+	if err == nil {
+		err = executor.StreamWithContext(hookCtx, remotecommand.StreamOptions{Stdout: stdout, Stderr: stderr})
+	}
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+
+	var exitErr utilexec.ExitError
+	switch {
+	case err == nil:
+		exitCode := 0
+		result.ExitCode = &exitCode
+	case errors.As(err, &exitErr):
+		exitCode := exitErr.ExitStatus()
+		result.ExitCode = &exitCode
+		result.Error = fmt.Sprintf("Command exited with code %d", exitCode)
+	case errors.Is(hookCtx.Err(), context.DeadlineExceeded):
+		result.Error = fmt.Sprintf("Command timed out after %s", timeout)
+	default:
+		result.Error = fmt.Sprintf("Error running command: %v", err)
+	}
+	if result.Error != "" {
+		fmt.Printf("[Backup] %s-backup hook %s failed in pod %s/%s: %s\n", phase, hook.Name, pod.Namespace, pod.Name, result.Error)
+	} else {
+		fmt.Printf("[Backup] %s-backup hook %s ran in pod %s/%s\n", phase, hook.Name, pod.Namespace, pod.Name)
+	}
+	return result
+}
+
+// hasContainer checks if the pod has a container of the name
+func hasContainer(pod v1.Pod, name string) bool {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getHookNamespaces returns the namespaces the hook runs in, all those of the
+// application unless the hook names one
+func getHookNamespaces(app Application, hook BackupHook) []string {
+	if hook.Namespace != "" {
+		return []string{hook.Namespace}
+	}
+	return getAppNamespaces(app)
+}
+
+// validateBackupHooks checks the hooks of a phase against the namespaces of the application
+func validateBackupHooks(hooks []BackupHook, namespaces []string) error {
+	names := make(map[string]bool, len(hooks))
+	for _, hook := range hooks {
+		if hook.Name == "" {
+			return errors.New("Backup hook without name")
+		}
+		if names[hook.Name] {
+			return fmt.Errorf("Duplicate backup hook %s", hook.Name)
+		}
+		names[hook.Name] = true
+		if hook.PodSelector == "" {
+			return fmt.Errorf("Backup hook %s needs a podSelector", hook.Name)
+		}
+		if _, err := labels.Parse(hook.PodSelector); err != nil {
+			return fmt.Errorf("Invalid podSelector of backup hook %s: %v", hook.Name, err)
+		}
+		if len(hook.Command) == 0 {
+			return fmt.Errorf("Backup hook %s needs a command", hook.Name)
+		}
+		if hook.TimeoutSeconds < 0 {
+			return fmt.Errorf("Invalid timeout of backup hook %s", hook.Name)
+		}
+		if hook.OnError != "" && hook.OnError != HookFail && hook.OnError != HookContinue {
+			return fmt.Errorf("Invalid onError policy %q of backup hook %s", hook.OnError, hook.Name)
+		}
+		if hook.Namespace != "" && !isAppNamespace(namespaces, hook.Namespace) {
+			return fmt.Errorf("Namespace %s of backup hook %s is not a namespace of the application", hook.Namespace, hook.Name)
+		}
+	}
+	return nil
+}
+
+// isAppNamespace checks if the namespace is one of those of the application
+func isAppNamespace(namespaces []string, namespace string) bool {
+	for _, appNamespace := range namespaces {
+		if appNamespace == namespace {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/constants"
+	"github.com/arzzon/app-backup-restore/internal/storage"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"github.com/arzzon/app-backup-restore/internal/utils/orchestratorClient"
+	"sort"
+	"strings"
+	"time"
+)
+
+// storeBackupManifest builds the manifest of a finished backup and writes it
+// into the backup directory
+func storeBackupManifest(report BackupReport, app Application, spec backupSpec, omittedKinds []ResourceKind, startTime time.Time) error {
+	manifest := BackupManifest{
+		BackupID:      report.BackupID,
+		AppID:         report.AppID,
+		AppVersion:    app.Version,
+		Namespace:     getAppNamespaces(app)[0],
+		Namespaces:    getAppNamespaces(app),
+		LabelSelector: app.LabelSelector,
+		FieldSelector: app.FieldSelector,
+		Mode:          spec.Mode,
+		ExcludedKinds: omittedKinds,
+		ExcludedNames: spec.ExcludedNames,
+		SanitizeRules: spec.SanitizeRules,
+		Timestamp:     startTime.UTC(),
+		ToolVersion:   constants.TOOL_VERSION,
+		Schedule:      spec.Schedule,
+		ObjectCounts:  make(map[ResourceKind]int),
+	}
+	server, version, err := orchestratorClient.GetClusterInfo("")
+	if err != nil {
+		fmt.Printf("[Backup] Error fetching cluster info for manifest of %s: %v\n", report.BackupID, err)
+	}
+	manifest.ClusterServer = server
+	manifest.KubernetesVersion = version
+
+	for _, kind := range getSortedKinds(report.Kinds) {
+		manifest.Kinds = append(manifest.Kinds, kind)
+		manifest.ObjectCounts[kind] = report.Kinds[kind].Count
+	}
+
+	dirPath := getBackupDir(report.BackupID)
+	manifest.Checksums, err = getBackupChecksums(dirPath)
+	if err != nil {
+		return fmt.Errorf("Error computing checksums: %v", err)
+	}
+	for path := range manifest.Checksums {
+		namespace, kind, name := getObjectFromPath(path)
+		if namespace == "" && isClusterScopedKind(kind) {
+			if manifest.ClusterScoped == nil {
+				manifest.ClusterScoped = make(map[ResourceKind][]string)
+			}
+			manifest.ClusterScoped[kind] = append(manifest.ClusterScoped[kind], name)
+		}
+	}
+	for kind := range manifest.ClusterScoped {
+		sort.Strings(manifest.ClusterScoped[kind])
+	}
+	manifest.OwnedObjects, err = getOwnedObjects(dirPath, manifest.Checksums, spec.DataKey)
+	if err != nil {
+		return fmt.Errorf("Error reading owner references: %v", err)
+	}
+
+	// The data key is wrapped under the rotation lock, so that a concurrent
+	// rotation cannot miss it
+	rotationLock.RLock()
+	defer rotationLock.RUnlock()
+	if spec.Encryption != "" {
+		if manifest.Encryption, err = wrapBackupKey(spec.Encryption, spec.DataKey); err != nil {
+			return err
+		}
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding manifest to JSON: %v", err)
+	}
+	return store.Put(storage.Join(dirPath, constants.BACKUP_MANIFEST_FILE), manifestData)
+}
+
+// updateBackupManifest applies the update to the stored manifest of a finished
+// backup and writes it back when the update reports a change. The restore
+// registry stays locked so that manifest updates and deletions of the backup
+// do not interleave.
+func updateBackupManifest(backupID string, update func(manifest *BackupManifest) (bool, error)) (*BackupManifest, error) {
+	activeRestores.Lock()
+	defer activeRestores.Unlock()
+	manifest, err := readBackupManifest(backupID)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := update(manifest)
+	if err != nil || !changed {
+		return manifest, err
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding manifest to JSON: %v", err)
+	}
+	return manifest, store.Put(storage.Join(getBackupDir(backupID), constants.BACKUP_MANIFEST_FILE), manifestData)
+}
+
+// readBackupManifest reads the manifest of the backup
+func readBackupManifest(backupID string) (*BackupManifest, error) {
+	manifestData, err := store.Get(storage.Join(getBackupDir(backupID), constants.BACKUP_MANIFEST_FILE))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("manifest of backup %s not found", backupID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest of backup %s: %v", backupID, err)
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fmt.Errorf("error decoding manifest of backup %s: %v", backupID, err)
+	}
+	return &manifest, nil
+}
+
+// verifyBackupManifest checks that the backup files match the manifest: every
+// file listed must be present with the recorded checksum, and no YAML file may
+// be present that the manifest does not know about
+func verifyBackupManifest(backupID string) (*BackupManifest, error) {
+	manifest, err := readBackupManifest(backupID)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.BackupID != backupID {
+		return nil, fmt.Errorf("manifest belongs to backup %s, not %s", manifest.BackupID, backupID)
+	}
+	checksums, err := getBackupChecksums(getBackupDir(backupID))
+	if err != nil {
+		return nil, fmt.Errorf("error computing checksums of backup %s: %v", backupID, err)
+	}
+	if err := compareChecksums(manifest, checksums); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// isLegacyBackup checks if the backup was taken before backups had a manifest.
+// Such backups have neither manifest nor report, unlike backups in progress.
+func isLegacyBackup(backupID string) bool {
+	dirPath := getBackupDir(backupID)
+	return !isBackupInProgress(backupID) &&
+		!storage.Exists(store, storage.Join(dirPath, constants.BACKUP_MANIFEST_FILE)) &&
+		!storage.Exists(store, storage.Join(dirPath, constants.BACKUP_REPORT_FILE))
+}
+
+// getBackupManifest reads the manifest of the backup, or builds it for a backup
+// taken before backups had a manifest. It reports whether the manifest was
+// built, the files of such a backup being unverified.
+func getBackupManifest(backupID string) (*BackupManifest, bool, error) {
+	if isLegacyBackup(backupID) {
+		manifest, err := getLegacyBackupManifest(backupID)
+		return manifest, true, err
+	}
+	manifest, err := readBackupManifest(backupID)
+	return manifest, false, err
+}
+
+// getLegacyBackupManifest builds the manifest of a backup taken before backups
+// had a manifest from its files. These keep the objects of their single
+// namespace in a directory per kind and were never encrypted. The checksums are
+// those of the files as they are, so they cannot be used to verify them.
+func getLegacyBackupManifest(backupID string) (*BackupManifest, error) {
+	dirPath := getBackupDir(backupID)
+	files, err := getBackupChecksums(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading files of backup %s: %v", backupID, err)
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	manifest := &BackupManifest{BackupID: backupID, Checksums: files, ObjectCounts: make(map[ResourceKind]int)}
+	for _, path := range paths {
+		_, kind, _ := getObjectFromPath(path)
+		if manifest.ObjectCounts[kind] == 0 {
+			manifest.Kinds = append(manifest.Kinds, kind)
+		}
+		manifest.ObjectCounts[kind]++
+		// The namespace the objects were backed up from is only recorded in
+		// the objects themselves
+		if manifest.Namespace == "" && !isClusterScopedKind(kind) {
+			objData, err := readBackupFile(storage.Join(dirPath, path), nil)
+			if err != nil {
+				return nil, err
+			}
+			obj, err := parseObject(objData)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding %s: %v", path, err)
+			}
+			manifest.Namespace = obj.GetNamespace()
+		}
+	}
+	manifest.OwnedObjects, err = getOwnedObjects(dirPath, files, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading owner references: %v", err)
+	}
+	return manifest, nil
+}
+
+// compareChecksums checks that the checksums of the YAML files of a backup
+// are exactly those recorded in its manifest
+func compareChecksums(manifest *BackupManifest, checksums map[string]string) error {
+	for path, checksum := range manifest.Checksums {
+		actual, ok := checksums[path]
+		if !ok {
+			return fmt.Errorf("file %s listed in the manifest is missing", path)
+		}
+		if actual != checksum {
+			return fmt.Errorf("checksum mismatch for %s", path)
+		}
+	}
+	for path := range checksums {
+		if _, ok := manifest.Checksums[path]; !ok {
+			return fmt.Errorf("file %s is not listed in the manifest", path)
+		}
+	}
+	return nil
+}
+
+// getBackupChecksums returns the hex encoded SHA-256 of every YAML file in the
+// backup directory, keyed by the path relative to the directory
+func getBackupChecksums(dirPath string) (map[string]string, error) {
+	checksums := make(map[string]string)
+	keys, err := store.List(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".yaml") {
+			continue
+		}
+		data, err := store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		checksums[strings.TrimPrefix(key, dirPath+"/")] = getChecksum(data)
+	}
+	return checksums, nil
+}
+
+// getChecksum returns the hex encoded SHA-256 of the data
+func getChecksum(data []byte) string {
+	checksum := sha256.Sum256(data)
+	return hex.EncodeToString(checksum[:])
+}
+
+// getObjectFromPath returns the namespace, kind and name of the object stored
+// in the backup file, given by its path relative to the backup directory. The
+// namespace is empty for cluster-scoped objects and for backups that are not
+// keyed by namespace.
+func getObjectFromPath(path string) (string, ResourceKind, string) {
+	parts := strings.Split(path, "/")
+	name := strings.TrimSuffix(parts[len(parts)-1], ".yaml")
+	if len(parts) < 3 {
+		return "", ResourceKind(parts[0]), name
+	}
+	namespace := parts[0]
+	if namespace == constants.CLUSTER_SCOPED_DIR {
+		namespace = ""
+	}
+	return namespace, ResourceKind(parts[1]), name
+}
+
+// getObjectKey returns the name of the object in reports, prefixed with its
+// namespace unless it is cluster-scoped
+func getObjectKey(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// getKindDir returns the directory holding the objects of the kind in the
+// namespace, or the cluster-scoped objects of the kind when it is empty
+func getKindDir(backupID, namespace string, kind ResourceKind) string {
+	if namespace == "" {
+		namespace = constants.CLUSTER_SCOPED_DIR
+	}
+	return storage.Join(getBackupDir(backupID), namespace, string(kind))
+}
+
+// isNamespacedLayout checks if the backup keeps the objects of each namespace
+// in their own directory. Earlier backups keep the objects of their single
+// namespace directly under the backup directory.
+func isNamespacedLayout(manifest *BackupManifest) bool {
+	return len(manifest.Namespaces) > 0
+}
+
+// getBackupDir returns the directory of the backup
+func getBackupDir(backupID string) string {
+	return storage.Join(constants.BACKUPS_DIR, backupID)
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/storage"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sort"
+)
+
+// ensureNamespaces creates the target namespaces that do not exist yet, with
+// the labels and annotations of the Namespace objects captured by the backup
+// and the overrides of the request. Existing namespaces are left untouched.
+// A dry run sends the namespaces through a server-side dry run instead and
+// remembers them, as the objects bound for them cannot be checked by the
+// API server.
+func (job *restoreJob) ensureNamespaces() error {
+	namespaceClient := job.Client.dynamic.Resource(v1.SchemeGroupVersion.WithResource("namespaces"))
+	sources := make([]string, 0, len(job.NamespaceMapping))
+	for source := range job.NamespaceMapping {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	handled := make(map[string]bool, len(sources))
+	for _, source := range sources {
+		target := job.NamespaceMapping[source]
+		if handled[target] {
+			continue
+		}
+		handled[target] = true
+		_, err := namespaceClient.Get(context.Background(), target, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("error fetching namespace %s: %v", target, err)
+		}
+
+		obj, err := job.getCapturedNamespace(source)
+		if err != nil {
+			return err
+		}
+		obj.SetName(target)
+		labels := obj.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		// Set by the API server to the name of the namespace
+		delete(labels, v1.LabelMetadataName)
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		override := job.Request.NamespaceOverrides[target]
+		for key, value := range override.Labels {
+			labels[key] = value
+		}
+		for key, value := range override.Annotations {
+			annotations[key] = value
+		}
+		obj.SetLabels(labels)
+		obj.SetAnnotations(annotations)
+		if err := job.transform(obj, Namespace); err != nil {
+			return err
+		}
+
+		if job.Request.DryRun {
+			if job.PlannedNamespaces == nil {
+				job.PlannedNamespaces = make(map[string]bool)
+			}
+			job.PlannedNamespaces[target] = true
+			_, err := namespaceClient.Create(context.Background(), obj, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+			if err != nil {
+				job.Response.Plan.Rejected = appendObjectError(job.Response.Plan.Rejected, Namespace, ObjectError{Name: target, Error: err.Error()})
+				continue
+			}
+			job.Response.Plan.New = appendName(job.Response.Plan.New, Namespace, target)
+			continue
+		}
+		created, err := namespaceClient.Create(context.Background(), obj, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("error creating namespace %s: %v", target, err)
+		}
+		fmt.Printf("[Restore] Namespace %s created\n", target)
+		job.Response.Created = appendName(job.Response.Created, Namespace, target)
+		job.CreatedObjects = append(job.CreatedObjects, restoredObject{Kind: Namespace, Name: target, UID: created.GetUID(), Client: namespaceClient})
+	}
+	return nil
+}
+
+// getCapturedNamespace returns the sanitized Namespace object of the source
+// namespace stored in the backup, or an empty one when the backup has none
+func (job *restoreJob) getCapturedNamespace(source string) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Namespace")
+	filePath := storage.Join(getKindDir(job.Manifest.BackupID, "", Namespace), source+".yaml")
+	if !isNamespacedLayout(job.Manifest) || !storage.Exists(store, filePath) {
+		return obj, nil
+	}
+	objData, err := readBackupFile(filePath, job.DataKey)
+	if err != nil {
+		return nil, fmt.Errorf("error reading YAML file %s: %v", filePath, err)
+	}
+	obj, err = parseObject(objData)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s YAML: %v", Namespace, err)
+	}
+	sanitizeObject(obj.Object, Namespace, SanitizeRestore, job.Manifest.SanitizeRules)
+	return obj, nil
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/storage"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"sort"
+)
+
+// getOwnedObjects returns the names of the backed up objects of each kind
+// whose owner references point to another backed up object, such as the
+// ReplicaSets of a Deployment and their Pods. The objects are decrypted with
+// the data key of the backup.
+func getOwnedObjects(dirPath string, checksums map[string]string, dataKey []byte) (map[ResourceKind][]string, error) {
+	objects := make(map[string]*unstructured.Unstructured, len(checksums))
+	uids := make(map[k8stypes.UID]bool, len(checksums))
+	for path := range checksums {
+		objData, err := readBackupFile(storage.Join(dirPath, path), dataKey)
+		if err != nil {
+			return nil, err
+		}
+		obj, err := parseObject(objData)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s: %v", path, err)
+		}
+		objects[path] = obj
+		if obj.GetUID() != "" {
+			uids[obj.GetUID()] = true
+		}
+	}
+
+	var ownedObjects map[ResourceKind][]string
+	for path, obj := range objects {
+		for _, ownerRef := range obj.GetOwnerReferences() {
+			if !uids[ownerRef.UID] {
+				continue
+			}
+			if ownedObjects == nil {
+				ownedObjects = make(map[ResourceKind][]string)
+			}
+			namespace, kind, name := getObjectFromPath(path)
+			ownedObjects[kind] = append(ownedObjects[kind], getObjectKey(namespace, name))
+			break
+		}
+	}
+	for kind := range ownedObjects {
+		sort.Strings(ownedObjects[kind])
+	}
+	return ownedObjects, nil
+}
+
+// isOwnedObject checks if the manifest records the object, named as in the
+// manifest, as owned
+func isOwnedObject(manifest *BackupManifest, kind ResourceKind, key string) bool {
+	for _, ownedKey := range manifest.OwnedObjects[kind] {
+		if ownedKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// mapOwnerReferences points the owner references of a restored object at the
+// restored owners, given the UIDs of the restored objects by their backed up
+// UID. References to owners that were not restored are dropped.
+func mapOwnerReferences(obj *unstructured.Unstructured, uids map[k8stypes.UID]k8stypes.UID) {
+	ownerRefs := obj.GetOwnerReferences()
+	if len(ownerRefs) == 0 {
+		return
+	}
+	var mappedRefs []metav1.OwnerReference
+	for _, ownerRef := range ownerRefs {
+		if uid, ok := uids[ownerRef.UID]; ok {
+			ownerRef.UID = uid
+			mappedRefs = append(mappedRefs, ownerRef)
+		}
+	}
+	obj.SetOwnerReferences(mappedRefs)
+}
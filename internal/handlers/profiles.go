@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/constants"
+	"github.com/arzzon/app-backup-restore/internal/storage"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TransformProfileHandler handles the stored transform profiles
+func TransformProfileHandler(w http.ResponseWriter, r *http.Request) {
+	name := getPathID(r.URL.Path, "/transform-profile/")
+	switch r.Method {
+	case http.MethodPut:
+		StoreTransformProfile(w, r, name)
+	case http.MethodGet:
+		if name == "" {
+			ListTransformProfiles(w, r)
+		} else {
+			GetTransformProfile(w, r, name)
+		}
+	case http.MethodDelete:
+		DeleteTransformProfile(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// StoreTransformProfile creates or replaces the transform profile
+func StoreTransformProfile(w http.ResponseWriter, r *http.Request, name string) {
+	if !isValidID(name) {
+		http.Error(w, "Invalid transform profile name", http.StatusBadRequest)
+		return
+	}
+	var profile TransformProfile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		fmt.Printf("[Transform Profile] Error unmarshalling request body: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateTransformRules(profile.Rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	profile.Name = name
+	profile.UpdatedAt = time.Now().UTC()
+	profileData, err := json.Marshal(profile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := store.Put(getTransformProfilePath(name), profileData); err != nil {
+		fmt.Printf("[Transform Profile] Error storing profile %s: %v\n", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, profile)
+	fmt.Printf("[Transform Profile] Profile %s stored\n", name)
+}
+
+// ListTransformProfiles lists the stored transform profiles
+func ListTransformProfiles(w http.ResponseWriter, r *http.Request) {
+	files, err := store.List(constants.TRANSFORM_PROFILES_DIR)
+	if err != nil {
+		fmt.Printf("[Transform Profile] Error listing profiles: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	profiles := []TransformProfile{}
+	for _, file := range files {
+		profile, err := readTransformProfile(strings.TrimPrefix(file, constants.TRANSFORM_PROFILES_DIR+"/"))
+		if err != nil {
+			fmt.Printf("[Transform Profile] Error reading profile %s: %v\n", file, err)
+			continue
+		}
+		profiles = append(profiles, *profile)
+	}
+	writeJSONResponse(w, http.StatusOK, profiles)
+}
+
+// GetTransformProfile returns the transform profile
+func GetTransformProfile(w http.ResponseWriter, r *http.Request, name string) {
+	profile, err := readTransformProfile(name)
+	if err != nil {
+		http.Error(w, err.Error(), getProfileStatusCode(err))
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, profile)
+}
+
+// DeleteTransformProfile deletes the transform profile
+func DeleteTransformProfile(w http.ResponseWriter, r *http.Request, name string) {
+	if _, err := readTransformProfile(name); err != nil {
+		http.Error(w, err.Error(), getProfileStatusCode(err))
+		return
+	}
+	if err := store.Delete(getTransformProfilePath(name)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]string{"name": name})
+	fmt.Printf("[Transform Profile] Profile %s deleted\n", name)
+}
+
+// readTransformProfile reads the stored transform profile
+func readTransformProfile(name string) (*TransformProfile, error) {
+	if !isValidID(name) || !storage.Exists(store, getTransformProfilePath(name)) {
+		return nil, errProfileNotFound
+	}
+	profileData, err := store.Get(getTransformProfilePath(name))
+	if err != nil {
+		return nil, err
+	}
+	var profile TransformProfile
+	if err := json.Unmarshal(profileData, &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// getProfileStatusCode maps transform profile lookup errors to HTTP status codes
+func getProfileStatusCode(err error) int {
+	if err == errProfileNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func getTransformProfilePath(name string) string {
+	return storage.Join(constants.TRANSFORM_PROFILES_DIR, name)
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/constants"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"time"
+)
+
+// readinessKinds are the kinds whose readiness is awaited after a restore
+var readinessKinds = map[ResourceKind]bool{
+	Delpoyment:  true,
+	StatefulSet: true,
+	PVC:         true,
+	Pod:         true,
+}
+
+// waitForReady polls the restored workloads until they are all ready or the
+// timeout expires, and returns the last state of each
+func waitForReady(workloads []restoredObject, timeout time.Duration) []WorkloadReadiness {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ticker := time.NewTicker(constants.READY_POLL_INTERVAL * time.Second)
+	defer ticker.Stop()
+	for {
+		readiness, allReady := getReadiness(ctx, workloads)
+		if allReady {
+			return readiness
+		}
+		select {
+		case <-ctx.Done():
+			for i := range readiness {
+				if !readiness[i].Ready && readiness[i].Message == "" {
+					readiness[i].Message = "Timed out waiting for readiness"
+				}
+			}
+			return readiness
+		case <-ticker.C:
+		}
+	}
+}
+
+// getReadiness fetches the current state of the workloads
+func getReadiness(ctx context.Context, workloads []restoredObject) ([]WorkloadReadiness, bool) {
+	allReady := true
+	readiness := make([]WorkloadReadiness, 0, len(workloads))
+	for _, workload := range workloads {
+		state := WorkloadReadiness{Kind: workload.Kind, Name: getObjectKey(workload.Namespace, workload.Name)}
+		obj, err := workload.Client.Get(ctx, workload.Name, metav1.GetOptions{})
+		if err != nil {
+			state.Message = fmt.Sprintf("Error fetching %s: %v", workload.Kind, err)
+		} else {
+			state.Ready, state.Message, err = isWorkloadReady(workload.Kind, obj)
+			if err != nil {
+				state.Message = err.Error()
+			}
+		}
+		allReady = allReady && state.Ready
+		readiness = append(readiness, state)
+	}
+	return readiness, allReady
+}
+
+// isWorkloadReady checks if the workload is ready, giving the reason when not
+func isWorkloadReady(kind ResourceKind, obj *unstructured.Unstructured) (bool, string, error) {
+	converter := runtime.DefaultUnstructuredConverter
+	switch kind {
+	case Delpoyment:
+		var deployment appsv1.Deployment
+		if err := converter.FromUnstructured(obj.Object, &deployment); err != nil {
+			return false, "", err
+		}
+		replicas := int32(1)
+		if deployment.Spec.Replicas != nil {
+			replicas = *deployment.Spec.Replicas
+		}
+		status := deployment.Status
+		if status.ObservedGeneration < deployment.Generation || status.UpdatedReplicas < replicas || status.AvailableReplicas < replicas {
+			return false, fmt.Sprintf("%d of %d replicas available", status.AvailableReplicas, replicas), nil
+		}
+		return true, "", nil
+	case StatefulSet:
+		var statefulSet appsv1.StatefulSet
+		if err := converter.FromUnstructured(obj.Object, &statefulSet); err != nil {
+			return false, "", err
+		}
+		replicas := int32(1)
+		if statefulSet.Spec.Replicas != nil {
+			replicas = *statefulSet.Spec.Replicas
+		}
+		status := statefulSet.Status
+		if status.ObservedGeneration < statefulSet.Generation || status.ReadyReplicas < replicas {
+			return false, fmt.Sprintf("%d of %d replicas ready", status.ReadyReplicas, replicas), nil
+		}
+		return true, "", nil
+	case PVC:
+		var claim v1.PersistentVolumeClaim
+		if err := converter.FromUnstructured(obj.Object, &claim); err != nil {
+			return false, "", err
+		}
+		if claim.Status.Phase != v1.ClaimBound {
+			return false, fmt.Sprintf("Claim is %s", getPhase(string(claim.Status.Phase))), nil
+		}
+		return true, "", nil
+	case Pod:
+		var pod v1.Pod
+		if err := converter.FromUnstructured(obj.Object, &pod); err != nil {
+			return false, "", err
+		}
+		if pod.Status.Phase == v1.PodSucceeded {
+			return true, "", nil
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+				return true, "", nil
+			}
+		}
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			if containerStatus.State.Waiting != nil && containerStatus.State.Waiting.Reason != "" {
+				return false, fmt.Sprintf("Container %s is waiting: %s", containerStatus.Name, containerStatus.State.Waiting.Reason), nil
+			}
+		}
+		return false, fmt.Sprintf("Pod is %s", getPhase(string(pod.Status.Phase))), nil
+	default:
+		return true, "", nil
+	}
+}
+
+// getPhase returns the phase, or unknown when the status has none yet
+func getPhase(phase string) string {
+	if phase == "" {
+		return "Unknown"
+	}
+	return phase
+}
@@ -5,22 +5,96 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/arzzon/app-backup-restore/internal/constants"
+	"github.com/arzzon/app-backup-restore/internal/storage"
 	. "github.com/arzzon/app-backup-restore/internal/types"
-	"github.com/arzzon/app-backup-restore/internal/utils/fileUtils"
 	"github.com/arzzon/app-backup-restore/internal/utils/orchestratorClient"
-	v12 "k8s.io/api/apps/v1"
-	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"net/http"
-	"os"
-	"path/filepath"
 	"sigs.k8s.io/yaml"
+	"sort"
+	"sync"
+	"time"
 )
 
-// Order of restoring backups
-var restoreOrder = []ResourceKind{ServiceAccount, Secret, ConfigMap, PV, PVC, StatefulSet, Delpoyment, ReplicaSet, Pod, Service}
+// Order of restoring backups. Kinds not listed, such as those of a discovery
+// backup, are restored afterwards in alphabetical order.
+var restoreOrder = []ResourceKind{ServiceAccount, Secret, ConfigMap, "LimitRange", "ResourceQuota",
+	"Role.rbac.authorization.k8s.io", "RoleBinding.rbac.authorization.k8s.io", PV, PVC,
+	StatefulSet, Delpoyment, ReplicaSet, Pod, Service}
+
+// restoreClient bundles the clients used to restore objects of any kind
+type restoreClient struct {
+	dynamic dynamic.Interface
+	mapper  meta.RESTMapper
+}
+
+// restoredObject is an object written by a restore
+type restoredObject struct {
+	Kind      ResourceKind
+	Namespace string
+	Name      string
+	UID       k8stypes.UID
+	Client    dynamic.ResourceInterface
+}
+
+// restoreJob holds the state of a single restore
+type restoreJob struct {
+	Client   *restoreClient
+	Manifest *BackupManifest
+	Request  RestoreRequest
+	// NamespaceMapping is the target namespace of each source namespace
+	NamespaceMapping map[string]string
+	// UIDs maps the backed up UID of each restored object to its new UID
+	UIDs     map[k8stypes.UID]k8stypes.UID
+	Response *RestoreResponse
+	// Workloads are the restored objects whose readiness is awaited
+	Workloads []restoredObject
+	// CreatedObjects are the objects created by the restore, in order
+	CreatedObjects []restoredObject
+	// Transforms are the transform rules of the profile and of the request
+	Transforms []TransformRule
+	// DataKey decrypts the encrypted objects of the backup
+	DataKey []byte
+	// PlannedNamespaces are the target namespaces a dry run would create
+	PlannedNamespaces map[string]bool
+	// VolumeClaims maps the name of each restored volume to the claim it is
+	// bound to, in its target namespace
+	VolumeClaims map[string]string
+}
+
+// activeRestores counts the restores running from each backup, so that a
+// backup cannot be deleted while it is being restored
+var activeRestores = struct {
+	sync.Mutex
+	backups map[string]int
+}{backups: make(map[string]int)}
+
+// startRestore marks a restore from the backup as running. It fails if the
+// backup does not exist, which can happen if it was deleted concurrently.
+func startRestore(backupID string) bool {
+	activeRestores.Lock()
+	defer activeRestores.Unlock()
+	if !checkIfBackupStored(backupID) {
+		return false
+	}
+	activeRestores.backups[backupID]++
+	return true
+}
+
+// endRestore marks a restore from the backup as finished
+func endRestore(backupID string) {
+	activeRestores.Lock()
+	defer activeRestores.Unlock()
+	activeRestores.backups[backupID]--
+	if activeRestores.backups[backupID] <= 0 {
+		delete(activeRestores.backups, backupID)
+	}
+}
 
 // RestoreBackupHandler handles the restore backup request
 func RestoreBackupHandler(w http.ResponseWriter, r *http.Request) {
@@ -43,8 +117,22 @@ func RestoreBackup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if restoreReq.Atomic && restoreReq.ConflictPolicy == ConflictOverwrite {
+		http.Error(w, "An atomic restore cannot overwrite existing objects", http.StatusBadRequest)
+		return
+	}
+	if err := validateConflictPolicy(restoreReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	transforms, err := getTransformRules(restoreReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Check if the backup exists
-	if !checkIfBackupStored(restoreReq.BackupID) {
+	if !isValidID(restoreReq.BackupID) || !startRestore(restoreReq.BackupID) {
 		restoreResponse := getRestoreResponse(restoreReq.Namespace, restoreReq.BackupID, "Backup not found")
 		jsonResponse, err := json.Marshal(restoreResponse)
 		if err != nil {
@@ -56,19 +144,98 @@ func RestoreBackup(w http.ResponseWriter, r *http.Request) {
 		w.Write(jsonResponse)
 		return
 	}
+	defer endRestore(restoreReq.BackupID)
 
-	// Restore resources in the order specified
-	for _, resourceKind := range restoreOrder {
-		fmt.Println("[Restore] Restoring resource: ", resourceKind)
-		err := parseAndRestore(restoreReq.BackupID, restoreReq.Namespace, resourceKind)
+	// Verify the backup against its manifest before applying anything. Backups
+	// taken before backups had a manifest cannot be verified and are restored
+	// with a warning.
+	var manifest *BackupManifest
+	var warnings []string
+	if isLegacyBackup(restoreReq.BackupID) {
+		fmt.Printf("[Restore] Backup %s has no manifest, restoring it unverified\n", restoreReq.BackupID)
+		manifest, err = getLegacyBackupManifest(restoreReq.BackupID)
+		warnings = append(warnings, "Backup has no manifest, its files were not verified")
+	} else {
+		manifest, err = verifyBackupManifest(restoreReq.BackupID)
+	}
+	if err != nil {
+		fmt.Printf("[Restore] Error verifying backup %s: %v\n", restoreReq.BackupID, err)
+		restoreResponse := getRestoreResponse(restoreReq.Namespace, restoreReq.BackupID, fmt.Sprintf("Backup verification failed: %v", err))
+		jsonResponse, err := json.Marshal(restoreResponse)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write(jsonResponse)
+		return
 	}
 
-	// Return response
+	namespaceMapping, err := getNamespaceMapping(manifest, restoreReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dataKey, err := getBackupKey(manifest)
+	if err != nil {
+		fmt.Printf("[Restore] Error reading data key of backup %s: %v\n", restoreReq.BackupID, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	dynamicClient, mapper, err := orchestratorClient.GetDynamicClientFromKubeconfig("")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	restoreResponse := getRestoreResponse(restoreReq.Namespace, restoreReq.BackupID, "Backup restored successfully")
+	if restoreReq.DryRun {
+		restoreResponse.Message = "Dry run completed, nothing was changed"
+		restoreResponse.Plan = &RestorePlan{}
+	}
+	restoreResponse.Warnings = warnings
+	restoreResponse.OmittedKinds = manifest.ExcludedKinds
+	restoreResponse.ExcludedNames = manifest.ExcludedNames
+	restoreResponse.NamespaceMapping = namespaceMapping
+	job := &restoreJob{
+		Client:           &restoreClient{dynamic: dynamicClient, mapper: mapper},
+		Manifest:         manifest,
+		Request:          restoreReq,
+		NamespaceMapping: namespaceMapping,
+		UIDs:             make(map[k8stypes.UID]k8stypes.UID),
+		Response:         &restoreResponse,
+		Transforms:       transforms,
+		DataKey:          dataKey,
+	}
+
+	if err := job.restore(); err != nil {
+		restoreResponse.Message = fmt.Sprintf("Restore failed: %v", err)
+		if restoreReq.Atomic {
+			job.rollback()
+			restoreResponse.Message += ", rolled back"
+		}
+		writeJSONResponse(w, getRestoreStatusCode(err), restoreResponse)
+		return
+	}
+
+	if restoreReq.WaitForReady && !restoreReq.DryRun {
+		timeout := constants.READY_TIMEOUT * time.Second
+		if restoreReq.ReadyTimeoutSeconds > 0 {
+			timeout = time.Duration(restoreReq.ReadyTimeoutSeconds) * time.Second
+		}
+		restoreResponse.Readiness = waitForReady(job.Workloads, timeout)
+		ready := true
+		for _, state := range restoreResponse.Readiness {
+			ready = ready && state.Ready
+		}
+		restoreResponse.Ready = &ready
+		if !ready {
+			restoreResponse.Message = "Backup restored, but some workloads are not ready"
+		}
+	}
+
+	// Return response
 	jsonResponse, err := json.Marshal(restoreResponse)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusOK)
@@ -79,162 +246,288 @@ func RestoreBackup(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonResponse)
 }
 
+// rollback deletes the objects created by the restore in reverse order. Only
+// objects with the UID they were created with are deleted, so that objects
+// which existed before the restore are never touched.
+func (job *restoreJob) rollback() {
+	for i := len(job.CreatedObjects) - 1; i >= 0; i-- {
+		object := job.CreatedObjects[i]
+		propagation := metav1.DeletePropagationBackground
+		err := object.Client.Delete(context.Background(), object.Name, metav1.DeleteOptions{
+			Preconditions:     &metav1.Preconditions{UID: &object.UID},
+			PropagationPolicy: &propagation,
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			fmt.Printf("[Restore] Error rolling back %s %s: %v\n", object.Kind, object.Name, err)
+			job.Response.RollbackErrors = appendObjectError(job.Response.RollbackErrors, object.Kind, ObjectError{Name: getObjectKey(object.Namespace, object.Name), Error: err.Error()})
+			continue
+		}
+		job.Response.RolledBack = appendName(job.Response.RolledBack, object.Kind, getObjectKey(object.Namespace, object.Name))
+	}
+}
+
 // checkIfBackupStored checks if the backup is stored in the backups directory
 func checkIfBackupStored(backupID string) bool {
-	dirPath := fmt.Sprintf("%s/%s", constants.BACKUPS_DIR, backupID)
 	// Check if the backup exists
-	return fileUtils.CheckDirectory(dirPath)
+	return storage.HasPrefix(store, getBackupDir(backupID))
 }
 
-// parseAndRestore parses the YAML files and restores the resources
-func parseAndRestore(backupID, namespace string, resourceKind ResourceKind) error {
-	yamlDir := fmt.Sprintf("%s/%s/%s", constants.BACKUPS_DIR, backupID, resourceKind)
-	if !fileUtils.CheckDirectory(yamlDir) {
-		return nil
+// getRestoreOrder sorts the kinds of the backup in the order they are restored
+func getRestoreOrder(kinds []ResourceKind) []ResourceKind {
+	priority := make(map[ResourceKind]int, len(restoreOrder))
+	for i, kind := range restoreOrder {
+		priority[kind] = i
 	}
+	orderedKinds := append([]ResourceKind{}, kinds...)
+	sort.SliceStable(orderedKinds, func(i, j int) bool {
+		iPriority, iKnown := priority[orderedKinds[i]]
+		jPriority, jKnown := priority[orderedKinds[j]]
+		switch {
+		case iKnown && jKnown:
+			return iPriority < jPriority
+		case iKnown != jKnown:
+			return iKnown
+		default:
+			return orderedKinds[i] < orderedKinds[j]
+		}
+	})
+	return orderedKinds
+}
 
-	// Get list of YAML files in directory
-	files, err := os.ReadDir(yamlDir)
-	if err != nil {
+// restore creates the missing target namespaces and restores the resources
+// of the backup in the order specified
+func (job *restoreJob) restore() error {
+	if err := job.ensureNamespaces(); err != nil {
+		fmt.Printf("[Restore] Error creating namespaces: %v\n", err)
 		return err
 	}
+	for _, resourceKind := range getRestoreOrder(job.Manifest.Kinds) {
+		// Namespaces are created up front
+		if resourceKind == Namespace {
+			continue
+		}
+		fmt.Println("[Restore] Restoring resource: ", resourceKind)
+		if err := job.parseAndRestore(resourceKind); err != nil {
+			fmt.Printf("[Restore] Error restoring %s: %v\n", resourceKind, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAndRestore parses the YAML files and restores the resources
+func (job *restoreJob) parseAndRestore(resourceKind ResourceKind) error {
+	if !isNamespacedLayout(job.Manifest) {
+		yamlDir := storage.Join(getBackupDir(job.Manifest.BackupID), string(resourceKind))
+		return job.restoreDir(resourceKind, yamlDir, job.Manifest.Namespace, "")
+	}
+	// The cluster-scoped objects follow those of the namespaces
+	for _, namespace := range append(append([]string{}, job.Manifest.Namespaces...), "") {
+		yamlDir := getKindDir(job.Manifest.BackupID, namespace, resourceKind)
+		if err := job.restoreDir(resourceKind, yamlDir, namespace, namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	var clientset *kubernetes.Clientset
-	clientset, err = orchestratorClient.GetClientFromKubeconfig("")
+// restoreDir restores the objects of the kind stored in the directory, backed
+// up from the source namespace. The manifest names them with keyNamespace.
+func (job *restoreJob) restoreDir(resourceKind ResourceKind, yamlDir, sourceNamespace, keyNamespace string) error {
+	namespace := job.NamespaceMapping[sourceNamespace]
+
+	// Get list of YAML files in directory
+	filePaths, err := store.List(yamlDir)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 
 	// Iterate over YAML files
-	for _, file := range files {
-		filePath := filepath.Join(yamlDir, file.Name())
-
+	for _, filePath := range filePaths {
 		// Read YAML file
-		yamlDataBytes, err := fileUtils.ReadFile(filePath)
+		yamlDataBytes, err := readBackupFile(filePath, job.DataKey)
 		if err != nil {
 			return fmt.Errorf("error reading YAML file %s: %v", filePath, err)
 		}
 
 		// Parse YAML
-		switch resourceKind {
-		case Pod:
-			pod := &v1.Pod{}
-			err := yaml.Unmarshal(yamlDataBytes, pod)
-			if err != nil {
-				return fmt.Errorf("error unmarshalling Pod YAML: %v", err)
-			}
-			pod.ResourceVersion = ""
-			_, err = clientset.CoreV1().Pods(namespace).Create(context.Background(), pod, metav1.CreateOptions{})
-			if err != nil && !errors.IsAlreadyExists(err) {
-				return fmt.Errorf("error creating Pod: %v", err)
-			}
-		case StatefulSet:
-			ss := &v12.StatefulSet{}
-			err := yaml.Unmarshal(yamlDataBytes, ss)
-			if err != nil {
-				return fmt.Errorf("error unmarshalling Pod StatefulSet: %v", err)
-			}
-			ss.ResourceVersion = ""
-			_, err = clientset.AppsV1().StatefulSets(namespace).Create(context.Background(), ss, metav1.CreateOptions{})
-			if err != nil && !errors.IsAlreadyExists(err) {
-				return fmt.Errorf("error creating StatefulSet: %v", err)
-			}
-		case Delpoyment:
-			deployment := &v12.Deployment{}
-			err = yaml.Unmarshal(yamlDataBytes, deployment)
-			if err != nil {
-				return fmt.Errorf("error unmarshalling Pod YAML: %v", err)
-			}
-			deployment.ResourceVersion = ""
-			_, err = clientset.AppsV1().Deployments(namespace).Create(context.Background(), deployment, metav1.CreateOptions{})
-			if err != nil && !errors.IsAlreadyExists(err) {
-				return fmt.Errorf("error restoring Deployment: %v", err)
-			}
-		case Service:
-			svc := &v1.Service{}
-			err = yaml.Unmarshal(yamlDataBytes, svc)
-			if err != nil {
-				return fmt.Errorf("error unmarshalling Service YAML: %v", err)
-			}
-			svc.ResourceVersion = ""
-			_, err = clientset.CoreV1().Services(namespace).Create(context.Background(), svc, metav1.CreateOptions{})
-			if err != nil && !errors.IsAlreadyExists(err) {
-				return fmt.Errorf("error creating Service: %v", err)
-			}
-		case ConfigMap:
-			cm := &v1.ConfigMap{}
-			err = yaml.Unmarshal(yamlDataBytes, cm)
-			if err != nil {
-				return fmt.Errorf("error unmarshalling ConfigMap YAML: %v", err)
-			}
-			cm.ResourceVersion = ""
-			_, err = clientset.CoreV1().ConfigMaps(namespace).Create(context.Background(), cm, metav1.CreateOptions{})
-			if err != nil && !errors.IsAlreadyExists(err) {
-				return fmt.Errorf("error creating ConfigMap: %v", err)
-			}
-		case ReplicaSet:
-			rs := &v12.ReplicaSet{}
-			err = yaml.Unmarshal(yamlDataBytes, rs)
-			if err != nil {
-				return fmt.Errorf("error unmarshalling ReplicaSet YAML: %v", err)
-			}
-			rs.ResourceVersion = ""
-			_, err = clientset.AppsV1().ReplicaSets(namespace).Create(context.Background(), rs, metav1.CreateOptions{})
-			if err != nil && !errors.IsAlreadyExists(err) {
-				return fmt.Errorf("error restoring ReplicaSet: %v", err)
-			}
-		case PV:
-			pv := &v1.PersistentVolume{}
-			err := yaml.Unmarshal(yamlDataBytes, pv)
-			if err != nil {
-				return fmt.Errorf("error unmarshalling PV YAML: %v", err)
-			}
-			pv.ResourceVersion = ""
-			_, err = clientset.CoreV1().PersistentVolumes().Create(context.Background(), pv, metav1.CreateOptions{})
-			if err != nil && !errors.IsAlreadyExists(err) {
-				return fmt.Errorf("error creating PersistentVolume: %v", err)
-			}
-		case PVC:
-			pvc := &v1.PersistentVolumeClaim{}
-			err := yaml.Unmarshal(yamlDataBytes, pvc)
-			if err != nil {
-				return fmt.Errorf("error unmarshalling PVC YAML: %v", err)
-			}
-			pvc.ResourceVersion = ""
-			_, err = clientset.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), pvc, metav1.CreateOptions{})
-			if err != nil && !errors.IsAlreadyExists(err) {
-				return fmt.Errorf("error creating PersistentVolumeClaims: %v", err)
-			}
-		case ServiceAccount:
-			sa := &v1.ServiceAccount{}
-			err := yaml.Unmarshal(yamlDataBytes, sa)
-			if err != nil {
-				return fmt.Errorf("error unmarshalling ServiceAccount YAML: %v", err)
-			}
-			sa.ResourceVersion = ""
-			_, err = clientset.CoreV1().ServiceAccounts(namespace).Create(context.Background(), sa, metav1.CreateOptions{})
-			if err != nil && !errors.IsAlreadyExists(err) {
-				return fmt.Errorf("error creating ServiceAccount: %v", err)
-			}
-		case Secret:
-			secret := &v1.Secret{}
-			err := yaml.Unmarshal(yamlDataBytes, secret)
-			if err != nil {
-				return fmt.Errorf("error unmarshalling Secret YAML: %v", err)
-			}
-			secret.ResourceVersion = ""
-			_, err = clientset.CoreV1().Secrets(namespace).Create(context.Background(), secret, metav1.CreateOptions{})
-			if err != nil && !errors.IsAlreadyExists(err) {
-				return fmt.Errorf("error creating Secret: %v", err)
-			}
-		default:
-			fmt.Printf("[Restore] Invalid resource type: %s", resourceKind)
+		obj, err := parseObject(yamlDataBytes)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling %s YAML: %v", resourceKind, err)
+		}
+		// Kinds of the typed backup are restored as their known type
+		if gvk, ok := typedKindGVKs[resourceKind]; ok {
+			obj.SetGroupVersionKind(gvk)
 		}
+		// Owned objects are re-created by the controllers of their restored owners
+		if !job.Request.RestoreOwnedObjects && isOwnedObject(job.Manifest, resourceKind, getObjectKey(keyNamespace, obj.GetName())) {
+			job.Response.SkippedOwnedObjects = appendName(job.Response.SkippedOwnedObjects, resourceKind, getObjectKey(keyNamespace, obj.GetName()))
+			continue
+		}
+		backupUID := obj.GetUID()
+		sanitizeObject(obj.Object, resourceKind, SanitizeRestore, job.Manifest.SanitizeRules)
+		mapOwnerReferences(obj, job.UIDs)
 
+		resourceClient, namespaced, err := job.Client.resourceFor(obj, namespace)
+		if err != nil {
+			return fmt.Errorf("error mapping %s: %v", resourceKind, err)
+		}
+		job.setRestoreNamespace(obj, namespace, namespaced)
+		job.setVolumeBinding(obj)
+		if err := job.transform(obj, resourceKind); err != nil {
+			return err
+		}
+		restored, err := job.createObject(resourceClient, resourceKind, obj)
+		if err != nil {
+			return err
+		}
+		if restored != nil && backupUID != "" {
+			job.UIDs[backupUID] = restored.GetUID()
+		}
+		if restored != nil && !job.Request.DryRun && readinessKinds[resourceKind] {
+			job.Workloads = append(job.Workloads, restoredObject{Kind: resourceKind, Namespace: restored.GetNamespace(), Name: restored.GetName(), Client: resourceClient})
+		}
 	}
 	return nil
 }
 
+// getNamespaceMapping returns the target namespace of each namespace of the
+// backup. Namespaces are restored into the namespace of the request when the
+// backup has a single one, into the namespace they are mapped to, or in place.
+func getNamespaceMapping(manifest *BackupManifest, restoreReq RestoreRequest) (map[string]string, error) {
+	sourceNamespaces := manifest.Namespaces
+	if !isNamespacedLayout(manifest) {
+		sourceNamespaces = []string{manifest.Namespace}
+	}
+	isSource := make(map[string]bool, len(sourceNamespaces))
+	for _, namespace := range sourceNamespaces {
+		isSource[namespace] = true
+	}
+	for source, target := range restoreReq.NamespaceMapping {
+		if !isSource[source] {
+			return nil, fmt.Errorf("Namespace %s is not part of backup %s", source, manifest.BackupID)
+		}
+		if err := validateNamespaces([]string{target}); err != nil {
+			return nil, err
+		}
+	}
+	if restoreReq.Namespace != "" {
+		if len(sourceNamespaces) > 1 {
+			return nil, fmt.Errorf("Backup %s spans several namespaces, use namespaceMapping to choose their targets", manifest.BackupID)
+		}
+		if err := validateNamespaces([]string{restoreReq.Namespace}); err != nil {
+			return nil, err
+		}
+	}
+
+	for target := range restoreReq.NamespaceOverrides {
+		if err := validateNamespaces([]string{target}); err != nil {
+			return nil, err
+		}
+	}
+
+	mapping := make(map[string]string, len(sourceNamespaces))
+	for _, source := range sourceNamespaces {
+		switch {
+		case restoreReq.NamespaceMapping[source] != "":
+			mapping[source] = restoreReq.NamespaceMapping[source]
+		case restoreReq.Namespace != "":
+			mapping[source] = restoreReq.Namespace
+		default:
+			mapping[source] = source
+		}
+	}
+	return mapping, nil
+}
+
+// setRestoreNamespace points the object at the namespace it is restored into,
+// and a volume bound to a restored claim at the claim's target namespace
+func (job *restoreJob) setRestoreNamespace(obj *unstructured.Unstructured, namespace string, namespaced bool) {
+	if namespaced {
+		obj.SetNamespace(namespace)
+		return
+	}
+	obj.SetNamespace("")
+	if obj.GetKind() != "PersistentVolume" {
+		return
+	}
+	claimNamespace, found, _ := unstructured.NestedString(obj.Object, "spec", "claimRef", "namespace")
+	if target, ok := job.NamespaceMapping[claimNamespace]; found && ok {
+		unstructured.SetNestedField(obj.Object, target, "spec", "claimRef", "namespace")
+	}
+}
+
+// setVolumeBinding records the claim a restored volume is bound to, and
+// unbinds a restored claim from its volume unless that volume is restored for
+// it. The volume of the backup is otherwise still bound to the original claim
+// or does not exist, and the claim would stay pending.
+func (job *restoreJob) setVolumeBinding(obj *unstructured.Unstructured) {
+	switch obj.GetKind() {
+	case "PersistentVolume":
+		claimNamespace, _, _ := unstructured.NestedString(obj.Object, "spec", "claimRef", "namespace")
+		claimName, found, _ := unstructured.NestedString(obj.Object, "spec", "claimRef", "name")
+		if !found {
+			return
+		}
+		if job.VolumeClaims == nil {
+			job.VolumeClaims = make(map[string]string)
+		}
+		job.VolumeClaims[obj.GetName()] = getObjectKey(claimNamespace, claimName)
+	case "PersistentVolumeClaim":
+		volumeName, _, _ := unstructured.NestedString(obj.Object, "spec", "volumeName")
+		if volumeName == "" {
+			return
+		}
+		if job.VolumeClaims[volumeName] == getObjectKey(obj.GetNamespace(), obj.GetName()) && job.isVolumeRestored(volumeName) {
+			return
+		}
+		unstructured.RemoveNestedField(obj.Object, "spec", "volumeName")
+	}
+}
+
+// isVolumeRestored checks if the restore created or overwrote the volume, or
+// would create it in a dry run
+func (job *restoreJob) isVolumeRestored(name string) bool {
+	names := append(append([]string{}, job.Response.Created[PV]...), job.Response.Updated[PV]...)
+	if job.Response.Plan != nil {
+		names = append(names, job.Response.Plan.New[PV]...)
+	}
+	for _, restoredName := range names {
+		if restoredName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseObject decodes a stored YAML object
+func parseObject(yamlData []byte) (*unstructured.Unstructured, error) {
+	jsonData, err := yaml.YAMLToJSON(yamlData)
+	if err != nil {
+		return nil, err
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(jsonData); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// resourceFor returns the dynamic client of the object's resource, scoped to
+// the namespace unless the resource is cluster-scoped, and whether the
+// resource is namespaced
+func (client *restoreClient) resourceFor(obj *unstructured.Unstructured, namespace string) (dynamic.ResourceInterface, bool, error) {
+	gvk := obj.GroupVersionKind()
+	mapping, err := client.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, false, err
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		return client.dynamic.Resource(mapping.Resource), false, nil
+	}
+	return client.dynamic.Resource(mapping.Resource).Namespace(namespace), true, nil
+}
+
 // getRestoreResponse returns the restore response
 func getRestoreResponse(namespace, backUpID, msg string) RestoreResponse {
 	// For simplicity, just return a success message
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/constants"
+	"github.com/arzzon/app-backup-restore/internal/storage"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// retention serializes the garbage collections and keeps the report of the
+// last one that pruned for real
+var retention = struct {
+	sync.Mutex
+	lastReport *RetentionReport
+}{}
+
+// retentionRule keeps the newest backup of each of the first count periods
+type retentionRule struct {
+	name   string
+	count  int
+	period func(backup *BackupManifest) string
+}
+
+// RetentionHandler handles the garbage collection requests
+func RetentionHandler(w http.ResponseWriter, r *http.Request) {
+	action := getPathID(r.URL.Path, "/retention/")
+	switch {
+	case r.Method == http.MethodGet && action == "":
+		GetRetentionReport(w, r)
+	case r.Method == http.MethodGet && action == "preview":
+		RunRetention(w, r, true)
+	case r.Method == http.MethodPost && action == "run":
+		RunRetention(w, r, false)
+	case action == "" || action == "preview" || action == "run":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// GetRetentionReport returns the report of the last garbage collection
+func GetRetentionReport(w http.ResponseWriter, r *http.Request) {
+	retention.Lock()
+	report := retention.lastReport
+	retention.Unlock()
+	if report == nil {
+		http.Error(w, "No garbage collection has run yet", http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, report)
+}
+
+// RunRetention applies the retention policies now, to the backups of the
+// application given by the app query parameter or to all of them. A dry run
+// only reports the backups that would be pruned.
+func RunRetention(w http.ResponseWriter, r *http.Request, dryRun bool) {
+	report, err := collectBackups(r.URL.Query().Get("app"), dryRun)
+	if err != nil {
+		fmt.Printf("[Retention] Error collecting backups: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, report)
+}
+
+// StartRetention runs the garbage collection of all the backups at the given
+// interval, if positive
+func StartRetention(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := collectBackups("", false); err != nil {
+				fmt.Printf("[Retention] Error collecting backups: %v\n", err)
+			}
+		}
+	}()
+}
+
+// applyRetentionAfterBackup prunes the backups of the application by its
+// retention policy, if any, once a scheduled backup is done
+func applyRetentionAfterBackup(appID string) {
+	app, err := readApplication(appID)
+	if err != nil || !hasRetentionRules(app.Retention) {
+		return
+	}
+	if _, err := collectBackups(appID, false); err != nil {
+		fmt.Printf("[Retention] Error collecting backups of %s: %v\n", appID, err)
+	}
+}
+
+// collectBackups applies the retention policy of each application to its
+// finished backups, or to those of the given application only, and prunes the
+// backups no rule keeps unless it is a dry run. Backups of applications
+// without a policy are left alone and not reported.
+func collectBackups(appID string, dryRun bool) (*RetentionReport, error) {
+	retention.Lock()
+	defer retention.Unlock()
+	report := &RetentionReport{
+		DryRun: dryRun,
+		Time:   time.Now().UTC(),
+		Pruned: []RetentionDecision{},
+		Kept:   []RetentionDecision{},
+	}
+	backupIDs, err := storage.ListChildren(store, constants.BACKUPS_DIR)
+	if err != nil {
+		return nil, err
+	}
+	// Backups still in progress have no manifest yet, but the task of a
+	// backup ends only after its manifest is written
+	backups := make(map[string][]*BackupManifest)
+	failed, inProgress := make(map[string]bool), make(map[string]bool)
+	for _, backupID := range backupIDs {
+		manifest, err := readBackupManifest(backupID)
+		if err != nil || (appID != "" && manifest.AppID != appID) {
+			continue
+		}
+		backups[manifest.AppID] = append(backups[manifest.AppID], manifest)
+		if backupReport, err := readBackupReport(backupID); err == nil && backupReport.Status == BackupFailed {
+			failed[backupID] = true
+		}
+		inProgress[backupID] = isBackupInProgress(backupID)
+	}
+
+	appIDs := make([]string, 0, len(backups))
+	for id := range backups {
+		appIDs = append(appIDs, id)
+	}
+	sort.Strings(appIDs)
+	for _, id := range appIDs {
+		app, err := readApplication(id)
+		if err != nil || !hasRetentionRules(app.Retention) {
+			continue
+		}
+		kept, pruned := applyRetentionPolicy(*app.Retention, backups[id], failed, inProgress, report.Time)
+		report.Kept = append(report.Kept, kept...)
+		for _, decision := range pruned {
+			if !dryRun {
+				if err := deleteBackup(decision.BackupID); err != nil {
+					fmt.Printf("[Retention] Error pruning backup %s of %s: %v\n", decision.BackupID, id, err)
+					if report.Errors == nil {
+						report.Errors = make(map[string]string)
+					}
+					report.Errors[decision.BackupID] = err.Error()
+					continue
+				}
+				fmt.Printf("[Retention] Backup %s of %s pruned: %s\n", decision.BackupID, id, decision.Reasons[0])
+			}
+			report.Pruned = append(report.Pruned, decision)
+		}
+	}
+	if !dryRun {
+		retention.lastReport = report
+		fmt.Printf("[Retention] Garbage collection pruned %d backups, kept %d\n", len(report.Pruned), len(report.Kept))
+	}
+	return report, nil
+}
+
+// applyRetentionPolicy splits the backups of an application into those kept
+// and those pruned by the policy, with the reasons of each decision. Pinned
+// backups and those under legal hold are always kept and do not count towards
+// the keep rules, nor do failed backups or those still in progress. The newest
+// finished backup that did not fail is always kept, so that retention never
+// leaves the application without one. Without keep rules, the backups younger
+// than the max age are kept.
+func applyRetentionPolicy(policy RetentionPolicy, backups []*BackupManifest, failed, inProgress map[string]bool, now time.Time) ([]RetentionDecision, []RetentionDecision) {
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Timestamp.After(backups[j].Timestamp)
+	})
+	latestID := ""
+	for _, backup := range backups {
+		if !failed[backup.BackupID] && !inProgress[backup.BackupID] {
+			latestID = backup.BackupID
+			break
+		}
+	}
+
+	rules := []retentionRule{
+		{name: "last", count: policy.KeepLast, period: func(backup *BackupManifest) string {
+			return backup.BackupID
+		}},
+		{name: "daily", count: policy.KeepDaily, period: func(backup *BackupManifest) string {
+			return backup.Timestamp.UTC().Format("2006-01-02")
+		}},
+		{name: "weekly", count: policy.KeepWeekly, period: func(backup *BackupManifest) string {
+			year, week := backup.Timestamp.UTC().ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{name: "monthly", count: policy.KeepMonthly, period: func(backup *BackupManifest) string {
+			return backup.Timestamp.UTC().Format("2006-01")
+		}},
+	}
+	periods := make([]map[string]bool, len(rules))
+	for i := range rules {
+		periods[i] = make(map[string]bool)
+	}
+	maxAge := time.Duration(policy.MaxAgeDays) * 24 * time.Hour
+
+	hasKeepRules := policy.KeepLast+policy.KeepDaily+policy.KeepWeekly+policy.KeepMonthly > 0
+	var kept, pruned []RetentionDecision
+	for _, backup := range backups {
+		decision := RetentionDecision{BackupID: backup.BackupID, AppID: backup.AppID, Timestamp: backup.Timestamp}
+		keep := true
+		switch {
+		case inProgress[backup.BackupID]:
+			decision.Reasons = []string{"in progress"}
+		case backup.LegalHold:
+			decision.Reasons = []string{"legal hold"}
+		case backup.Pinned:
+			decision.Reasons = []string{"pinned"}
+		case policy.MaxAgeDays > 0 && now.Sub(backup.Timestamp) > maxAge && backup.BackupID != latestID:
+			decision.Reasons, keep = []string{fmt.Sprintf("older than %d days", policy.MaxAgeDays)}, false
+		default:
+			if !failed[backup.BackupID] {
+				for i, rule := range rules {
+					period := rule.period(backup)
+					if len(periods[i]) < rule.count && !periods[i][period] {
+						periods[i][period] = true
+						decision.Reasons = append(decision.Reasons, rule.name)
+					}
+				}
+			}
+			if backup.BackupID == latestID {
+				decision.Reasons = append(decision.Reasons, "latest successful backup")
+			}
+			if !hasKeepRules && now.Sub(backup.Timestamp) <= maxAge {
+				decision.Reasons = append(decision.Reasons, fmt.Sprintf("younger than %d days", policy.MaxAgeDays))
+			}
+			if len(decision.Reasons) == 0 {
+				decision.Reasons, keep = []string{"not kept by any rule"}, false
+				if failed[backup.BackupID] {
+					decision.Reasons = []string{"failed, not kept by any rule"}
+				}
+			}
+		}
+		if keep {
+			kept = append(kept, decision)
+		} else {
+			pruned = append(pruned, decision)
+		}
+	}
+	return kept, pruned
+}
+
+// hasRetentionRules checks if the policy can prune anything
+func hasRetentionRules(policy *RetentionPolicy) bool {
+	return policy != nil && policy.KeepLast+policy.KeepDaily+policy.KeepWeekly+policy.KeepMonthly+policy.MaxAgeDays > 0
+}
+
+// validateRetentionPolicy checks the retention policy of an application
+func validateRetentionPolicy(policy *RetentionPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	if policy.KeepLast < 0 || policy.KeepDaily < 0 || policy.KeepWeekly < 0 || policy.KeepMonthly < 0 || policy.MaxAgeDays < 0 {
+		return errors.New("Retention counts cannot be negative")
+	}
+	if !hasRetentionRules(policy) {
+		return errors.New("Retention policy needs a keep rule or maxAgeDays")
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyRetentionPolicy(t *testing.T) {
+	// A Sunday, the last day of ISO week 13
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	type testBackup struct {
+		id         string
+		timestamp  string
+		pinned     bool
+		legalHold  bool
+		failed     bool
+		inProgress bool
+	}
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		backups []testBackup
+		// wantKept maps the kept backups to the reasons they are kept
+		wantKept   map[string][]string
+		wantPruned []string
+	}{
+		{
+			name:   "daily at midnight UTC",
+			policy: RetentionPolicy{KeepDaily: 2},
+			backups: []testBackup{
+				{id: "sun-10h", timestamp: "2024-03-31T10:00:00Z"},
+				{id: "sun-00h", timestamp: "2024-03-31T00:00:00Z"},
+				// 01:00 in Paris is still Saturday in UTC
+				{id: "sat-23h", timestamp: "2024-03-31T01:00:00+02:00"},
+				{id: "sat-00h", timestamp: "2024-03-30T00:00:00Z"},
+				{id: "fri-23h", timestamp: "2024-03-29T23:59:59Z"},
+			},
+			wantKept: map[string][]string{
+				"sun-10h": {"daily", "latest successful backup"},
+				"sat-23h": {"daily"},
+			},
+			wantPruned: []string{"sun-00h", "sat-00h", "fri-23h"},
+		},
+		{
+			name:   "weekly at Monday",
+			policy: RetentionPolicy{KeepWeekly: 2},
+			backups: []testBackup{
+				{id: "w13-sun", timestamp: "2024-03-31T10:00:00Z"},
+				{id: "w13-mon", timestamp: "2024-03-25T00:00:00Z"},
+				{id: "w12-sun", timestamp: "2024-03-24T23:59:59Z"},
+				{id: "w12-mon", timestamp: "2024-03-18T00:00:00Z"},
+				{id: "w11-sun", timestamp: "2024-03-17T23:59:59Z"},
+			},
+			wantKept: map[string][]string{
+				"w13-sun": {"weekly", "latest successful backup"},
+				"w12-sun": {"weekly"},
+			},
+			wantPruned: []string{"w13-mon", "w12-mon", "w11-sun"},
+		},
+		{
+			// ISO weeks span the new year: 2021-01-03 is in week 53 of 2020
+			name:   "weekly across the new year",
+			policy: RetentionPolicy{KeepWeekly: 3},
+			backups: []testBackup{
+				{id: "2021-w01", timestamp: "2021-01-04T00:00:00Z"},
+				{id: "2020-w53-sun", timestamp: "2021-01-03T23:00:00Z"},
+				{id: "2020-w53-thu", timestamp: "2020-12-31T12:00:00Z"},
+				{id: "2020-w52", timestamp: "2020-12-27T12:00:00Z"},
+			},
+			wantKept: map[string][]string{
+				"2021-w01":     {"weekly", "latest successful backup"},
+				"2020-w53-sun": {"weekly"},
+				"2020-w52":     {"weekly"},
+			},
+			wantPruned: []string{"2020-w53-thu"},
+		},
+		{
+			name:   "monthly at the first day",
+			policy: RetentionPolicy{KeepMonthly: 2},
+			backups: []testBackup{
+				{id: "mar-31", timestamp: "2024-03-31T10:00:00Z"},
+				{id: "mar-01", timestamp: "2024-03-01T00:00:00Z"},
+				{id: "feb-29", timestamp: "2024-02-29T23:59:59Z"},
+				{id: "feb-01", timestamp: "2024-02-01T00:00:00Z"},
+				{id: "jan-31", timestamp: "2024-01-31T23:59:59Z"},
+			},
+			wantKept: map[string][]string{
+				"mar-31": {"monthly", "latest successful backup"},
+				"feb-29": {"monthly"},
+			},
+			wantPruned: []string{"mar-01", "feb-01", "jan-31"},
+		},
+		{
+			name:   "grandfather-father-son",
+			policy: RetentionPolicy{KeepLast: 1, KeepDaily: 2, KeepWeekly: 2, KeepMonthly: 2},
+			backups: []testBackup{
+				{id: "mar-31", timestamp: "2024-03-31T10:00:00Z"},
+				{id: "mar-30", timestamp: "2024-03-30T10:00:00Z"},
+				{id: "mar-29", timestamp: "2024-03-29T10:00:00Z"},
+				{id: "mar-24", timestamp: "2024-03-24T10:00:00Z"},
+				{id: "mar-17", timestamp: "2024-03-17T10:00:00Z"},
+				{id: "feb-29", timestamp: "2024-02-29T10:00:00Z"},
+				{id: "jan-31", timestamp: "2024-01-31T10:00:00Z"},
+			},
+			wantKept: map[string][]string{
+				"mar-31": {"last", "daily", "weekly", "monthly", "latest successful backup"},
+				"mar-30": {"daily"},
+				"mar-24": {"weekly"},
+				"feb-29": {"monthly"},
+			},
+			wantPruned: []string{"mar-29", "mar-17", "jan-31"},
+		},
+		{
+			name:   "max age",
+			policy: RetentionPolicy{MaxAgeDays: 7},
+			backups: []testBackup{
+				{id: "7-days", timestamp: "2024-03-24T12:00:00Z"},
+				{id: "over-7-days", timestamp: "2024-03-24T11:59:59Z"},
+			},
+			wantKept: map[string][]string{
+				"7-days": {"latest successful backup", "younger than 7 days"},
+			},
+			wantPruned: []string{"over-7-days"},
+		},
+		{
+			name:   "max age keeps the latest successful backup",
+			policy: RetentionPolicy{MaxAgeDays: 7},
+			backups: []testBackup{
+				{id: "failed", timestamp: "2024-03-31T10:00:00Z", failed: true},
+				{id: "old", timestamp: "2024-03-01T10:00:00Z"},
+				{id: "older", timestamp: "2024-02-01T10:00:00Z"},
+			},
+			wantKept: map[string][]string{
+				"failed": {"younger than 7 days"},
+				"old":    {"latest successful backup"},
+			},
+			wantPruned: []string{"older"},
+		},
+		{
+			name:   "failed backups do not count",
+			policy: RetentionPolicy{KeepLast: 1, KeepDaily: 1},
+			backups: []testBackup{
+				{id: "failed", timestamp: "2024-03-31T11:00:00Z", failed: true},
+				{id: "completed", timestamp: "2024-03-31T10:00:00Z"},
+			},
+			wantKept: map[string][]string{
+				"completed": {"last", "daily", "latest successful backup"},
+			},
+			wantPruned: []string{"failed"},
+		},
+		{
+			name:   "pinned, held and in progress backups are never pruned",
+			policy: RetentionPolicy{KeepLast: 1, MaxAgeDays: 30},
+			backups: []testBackup{
+				{id: "in-progress", timestamp: "2024-03-31T11:00:00Z", inProgress: true},
+				{id: "latest", timestamp: "2024-03-31T10:00:00Z"},
+				{id: "previous", timestamp: "2024-03-30T10:00:00Z"},
+				{id: "pinned", timestamp: "2023-01-01T00:00:00Z", pinned: true},
+				{id: "held", timestamp: "2023-01-01T00:00:00Z", legalHold: true},
+				{id: "held-failed", timestamp: "2023-01-01T00:00:00Z", legalHold: true, failed: true},
+				{id: "stale-in-progress", timestamp: "2023-01-01T00:00:00Z", inProgress: true},
+				{id: "expired", timestamp: "2023-01-01T00:00:00Z"},
+			},
+			wantKept: map[string][]string{
+				"in-progress":       {"in progress"},
+				"latest":            {"last", "latest successful backup"},
+				"pinned":            {"pinned"},
+				"held":              {"legal hold"},
+				"held-failed":       {"legal hold"},
+				"stale-in-progress": {"in progress"},
+			},
+			wantPruned: []string{"previous", "expired"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var backups []*BackupManifest
+			failed, inProgress := make(map[string]bool), make(map[string]bool)
+			for _, backup := range test.backups {
+				timestamp, err := time.Parse(time.RFC3339, backup.timestamp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				backups = append(backups, &BackupManifest{BackupID: backup.id, AppID: "app1", Timestamp: timestamp, Pinned: backup.pinned, LegalHold: backup.legalHold})
+				failed[backup.id], inProgress[backup.id] = backup.failed, backup.inProgress
+			}
+			// The policy sorts the backups itself
+			backups[0], backups[len(backups)-1] = backups[len(backups)-1], backups[0]
+
+			kept, pruned := applyRetentionPolicy(test.policy, backups, failed, inProgress, now)
+			gotKept := make(map[string][]string)
+			for _, decision := range kept {
+				gotKept[decision.BackupID] = decision.Reasons
+			}
+			if !reflect.DeepEqual(gotKept, test.wantKept) {
+				t.Errorf("kept = %v, want %v", gotKept, test.wantKept)
+			}
+			var gotPruned []string
+			for _, decision := range pruned {
+				gotPruned = append(gotPruned, decision.BackupID)
+			}
+			if !reflect.DeepEqual(gotPruned, test.wantPruned) {
+				t.Errorf("pruned = %v, want %v", gotPruned, test.wantPruned)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"fmt"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"strings"
+)
+
+// defaultSanitizeRules strip the fields populated by the API server or tied to
+// the source cluster. The UID and owner references are kept in the backup so
+// that the ownership between objects can still be worked out.
+var defaultSanitizeRules = []SanitizeRule{
+	{
+		Kind:   "*",
+		Phase:  SanitizeBoth,
+		Fields: []string{"metadata.resourceVersion", "metadata.managedFields", "metadata.selfLink", "metadata.generation"},
+	},
+	{
+		Kind:   "*",
+		Phase:  SanitizeRestore,
+		Fields: []string{"metadata.uid", "metadata.creationTimestamp", "status"},
+	},
+	{
+		Kind:   Service,
+		Phase:  SanitizeRestore,
+		Fields: []string{"spec.clusterIP", "spec.clusterIPs"},
+	},
+	{
+		Kind:   Pod,
+		Phase:  SanitizeRestore,
+		Fields: []string{"spec.nodeName"},
+	},
+	{
+		Kind:  PVC,
+		Phase: SanitizeRestore,
+		Annotations: []string{"pv.kubernetes.io/bind-completed", "pv.kubernetes.io/bound-by-controller",
+			"volume.beta.kubernetes.io/storage-provisioner", "volume.kubernetes.io/storage-provisioner",
+			"volume.kubernetes.io/selected-node"},
+	},
+	{
+		Kind:        PV,
+		Phase:       SanitizeRestore,
+		Fields:      []string{"spec.claimRef.uid", "spec.claimRef.resourceVersion"},
+		Annotations: []string{"pv.kubernetes.io/bound-by-controller"},
+	},
+}
+
+// sanitizeObject applies the default rules and the given rules of the phase
+// to an object of the kind
+func sanitizeObject(obj map[string]interface{}, kind ResourceKind, phase SanitizePhase, rules []SanitizeRule) {
+	allRules := append(append([]SanitizeRule{}, defaultSanitizeRules...), rules...)
+	for _, rule := range allRules {
+		if rule.Phase != phase && rule.Phase != SanitizeBoth {
+			continue
+		}
+		if rule.Kind != "*" && !kindMatches(kind, string(rule.Kind)) {
+			continue
+		}
+		for _, field := range rule.Fields {
+			unstructured.RemoveNestedField(obj, strings.Split(field, ".")...)
+		}
+		for _, annotation := range rule.Annotations {
+			unstructured.RemoveNestedField(obj, "metadata", "annotations", annotation)
+		}
+	}
+	if annotations, found, _ := unstructured.NestedMap(obj, "metadata", "annotations"); found && len(annotations) == 0 {
+		unstructured.RemoveNestedField(obj, "metadata", "annotations")
+	}
+}
+
+// validateSanitizeRules checks that the rules name a kind, a phase and fields
+func validateSanitizeRules(rules []SanitizeRule) error {
+	for _, rule := range rules {
+		if rule.Kind == "" {
+			return fmt.Errorf("Sanitize rule without kind, use \"*\" for every kind")
+		}
+		if rule.Phase != SanitizeBackup && rule.Phase != SanitizeRestore && rule.Phase != SanitizeBoth {
+			return fmt.Errorf("Invalid sanitize phase %q for %s", rule.Phase, rule.Kind)
+		}
+		for _, field := range rule.Fields {
+			if field == "" || strings.HasPrefix(field, ".") || strings.HasSuffix(field, ".") || strings.Contains(field, "..") {
+				return fmt.Errorf("Invalid sanitize field %q for %s", field, rule.Kind)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeObject(t *testing.T) {
+	tests := []struct {
+		name  string
+		kind  ResourceKind
+		phase SanitizePhase
+		rules []SanitizeRule
+		input string
+		// removed are the dot separated fields that must be gone, kept those
+		// that must be left
+		removed []string
+		kept    []string
+	}{
+		{
+			name:  "server-populated fields on backup",
+			kind:  ConfigMap,
+			phase: SanitizeBackup,
+			input: `
+apiVersion: v1
+kind: ConfigMap
+metadata: {name: cm, namespace: ns1, uid: u1, resourceVersion: "7", generation: 2, selfLink: /x, managedFields: [{}]}
+data: {a: b}`,
+			removed: []string{"metadata.resourceVersion", "metadata.generation", "metadata.selfLink", "metadata.managedFields"},
+			kept:    []string{"metadata.uid", "data.a"},
+		},
+		{
+			name:  "uid, creation timestamp and status on restore",
+			kind:  ConfigMap,
+			phase: SanitizeRestore,
+			input: `
+apiVersion: v1
+kind: ConfigMap
+metadata: {name: cm, namespace: ns1, uid: u1, creationTimestamp: "2024-01-01T00:00:00Z"}
+status: {x: y}`,
+			removed: []string{"metadata.uid", "metadata.creationTimestamp", "status"},
+			kept:    []string{"metadata.name", "metadata.namespace"},
+		},
+		{
+			name:  "Service cluster IPs",
+			kind:  Service,
+			phase: SanitizeRestore,
+			input: `
+apiVersion: v1
+kind: Service
+metadata: {name: web}
+spec: {clusterIP: 10.0.0.5, clusterIPs: [10.0.0.5], ports: [{port: 80}]}`,
+			removed: []string{"spec.clusterIP", "spec.clusterIPs"},
+			kept:    []string{"spec.ports"},
+		},
+		{
+			name:  "Service cluster IPs are kept in the backup",
+			kind:  Service,
+			phase: SanitizeBackup,
+			input: `
+apiVersion: v1
+kind: Service
+metadata: {name: web}
+spec: {clusterIP: 10.0.0.5}`,
+			kept: []string{"spec.clusterIP"},
+		},
+		{
+			name:  "Pod node name",
+			kind:  Pod,
+			phase: SanitizeRestore,
+			input: `
+apiVersion: v1
+kind: Pod
+metadata: {name: db-0}
+spec: {nodeName: node-1, containers: [{name: c, image: nginx}]}`,
+			removed: []string{"spec.nodeName"},
+			kept:    []string{"spec.containers"},
+		},
+		{
+			// The volume name is dropped at restore by setVolumeBinding, which
+			// knows whether the volume is restored along
+			name:  "PVC binding annotations",
+			kind:  PVC,
+			phase: SanitizeRestore,
+			input: `
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: data
+  annotations:
+    pv.kubernetes.io/bind-completed: "yes"
+    pv.kubernetes.io/bound-by-controller: "yes"
+    volume.kubernetes.io/storage-provisioner: csi
+    volume.kubernetes.io/selected-node: node-1
+spec: {volumeName: pv-data, storageClassName: std}`,
+			removed: []string{"metadata.annotations"},
+			kept:    []string{"spec.volumeName", "spec.storageClassName"},
+		},
+		{
+			name:  "PV claim reference",
+			kind:  PV,
+			phase: SanitizeRestore,
+			input: `
+apiVersion: v1
+kind: PersistentVolume
+metadata: {name: pv-data, annotations: {pv.kubernetes.io/bound-by-controller: "yes", owner: team-a}}
+spec: {claimRef: {namespace: ns1, name: data, uid: u1, resourceVersion: "3"}}`,
+			removed: []string{"spec.claimRef.uid", "spec.claimRef.resourceVersion", "metadata.annotations.pv\\.kubernetes\\.io/bound-by-controller"},
+			kept:    []string{"spec.claimRef.namespace", "spec.claimRef.name", "metadata.annotations.owner"},
+		},
+		{
+			name:  "custom rules of the kind and of every kind",
+			kind:  Delpoyment,
+			phase: SanitizeRestore,
+			rules: []SanitizeRule{
+				{Kind: "Deployment", Phase: SanitizeRestore, Fields: []string{"spec.replicas"}},
+				{Kind: "*", Phase: SanitizeBoth, Annotations: []string{"deployment.kubernetes.io/revision"}},
+				{Kind: "Deployment", Phase: SanitizeBackup, Fields: []string{"spec.paused"}},
+				{Kind: ConfigMap, Phase: SanitizeRestore, Fields: []string{"spec.strategy"}},
+			},
+			input: `
+apiVersion: apps/v1
+kind: Deployment
+metadata: {name: web, annotations: {deployment.kubernetes.io/revision: "4"}}
+spec: {replicas: 3, paused: true, strategy: {type: Recreate}}`,
+			removed: []string{"spec.replicas", "metadata.annotations"},
+			kept:    []string{"spec.paused", "spec.strategy.type"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			obj, err := parseObject([]byte(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sanitizeObject(obj.Object, test.kind, test.phase, test.rules)
+			for _, field := range test.removed {
+				if _, found, _ := unstructured.NestedFieldNoCopy(obj.Object, splitField(field)...); found {
+					t.Errorf("%s was kept", field)
+				}
+			}
+			for _, field := range test.kept {
+				if _, found, _ := unstructured.NestedFieldNoCopy(obj.Object, splitField(field)...); !found {
+					t.Errorf("%s was removed", field)
+				}
+			}
+		})
+	}
+}
+
+// splitField splits a dot separated field, in which "\." escapes a dot
+func splitField(field string) []string {
+	parts := strings.Split(strings.ReplaceAll(field, `\.`, "\x00"), ".")
+	for i := range parts {
+		parts[i] = strings.ReplaceAll(parts[i], "\x00", ".")
+	}
+	return parts
+}
+
+func TestSetVolumeBinding(t *testing.T) {
+	pv := `
+apiVersion: v1
+kind: PersistentVolume
+metadata: {name: pv-data}
+spec: {claimRef: {namespace: ns2, name: data}}`
+	pvc := `
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata: {name: data, namespace: ns2}
+spec: {volumeName: pv-data}`
+	tests := []struct {
+		name     string
+		response RestoreResponse
+		claim    string
+		want     string
+	}{
+		{
+			name:     "volume created for the claim",
+			response: RestoreResponse{Created: map[ResourceKind][]string{PV: {"pv-data"}}},
+			claim:    pvc,
+			want:     "pv-data",
+		},
+		{
+			name:     "volume overwritten for the claim",
+			response: RestoreResponse{Updated: map[ResourceKind][]string{PV: {"pv-data"}}},
+			claim:    pvc,
+			want:     "pv-data",
+		},
+		{
+			name:     "volume planned by a dry run",
+			response: RestoreResponse{Plan: &RestorePlan{New: map[ResourceKind][]string{PV: {"pv-data"}}}},
+			claim:    pvc,
+			want:     "pv-data",
+		},
+		{
+			name:     "existing volume skipped",
+			response: RestoreResponse{Skipped: map[ResourceKind][]string{PV: {"pv-data"}}},
+			claim:    pvc,
+		},
+		{
+			name:     "volume bound to a claim of another namespace",
+			response: RestoreResponse{Created: map[ResourceKind][]string{PV: {"pv-data"}}},
+			claim:    strings.Replace(pvc, "namespace: ns2", "namespace: ns3", 1),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			job := &restoreJob{Response: &test.response}
+			volume, err := parseObject([]byte(pv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			job.setVolumeBinding(volume)
+			if want := map[string]string{"pv-data": "ns2/data"}; !reflect.DeepEqual(job.VolumeClaims, want) {
+				t.Fatalf("VolumeClaims = %v, want %v", job.VolumeClaims, want)
+			}
+			claim, err := parseObject([]byte(test.claim))
+			if err != nil {
+				t.Fatal(err)
+			}
+			job.setVolumeBinding(claim)
+			if got, _, _ := unstructured.NestedString(claim.Object, "spec", "volumeName"); got != test.want {
+				t.Errorf("volumeName = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
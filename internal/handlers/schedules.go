@@ -0,0 +1,465 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/constants"
+	"github.com/arzzon/app-backup-restore/internal/storage"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errScheduleNotFound = errors.New("schedule not found")
+
+// scheduler holds the schedules in memory, so that the scheduler loop does not
+// read the store. Every change is written through to the store while holding
+// the writes lock, the map lock being only held to read or replace entries so
+// that reading the schedules never waits for the store.
+var scheduler = struct {
+	sync.Mutex
+	writes    sync.Mutex
+	schedules map[string]*Schedule
+}{schedules: make(map[string]*Schedule)}
+
+// ScheduleHandler handles the backup schedules
+func ScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(getPathID(r.URL.Path, "/schedule/"), "/")
+	if action != "" && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		StoreSchedule(w, r, name)
+	case http.MethodGet:
+		if name == "" {
+			ListSchedules(w, r)
+		} else {
+			GetSchedule(w, r, name)
+		}
+	case http.MethodPost:
+		switch action {
+		case "pause":
+			PauseSchedule(w, r, name, true)
+		case "resume":
+			PauseSchedule(w, r, name, false)
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	case http.MethodDelete:
+		DeleteSchedule(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// StoreSchedule creates or replaces the schedule. The run state of a replaced
+// schedule is kept, and its next run computed again.
+func StoreSchedule(w http.ResponseWriter, r *http.Request, name string) {
+	if !isValidID(name) {
+		http.Error(w, "Invalid schedule name", http.StatusBadRequest)
+		return
+	}
+	var schedule Schedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		fmt.Printf("[Schedule] Error unmarshalling request body: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	schedule.Name = name
+	if err := validateSchedule(schedule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	scheduler.writes.Lock()
+	defer scheduler.writes.Unlock()
+	// The run state is never taken from the request
+	state, _ := getSchedule(name)
+	schedule.LastRun, schedule.LastBackupID, schedule.LastTaskID = state.LastRun, state.LastBackupID, state.LastTaskID
+	schedule.LastError, schedule.MissedRuns, schedule.LastMissedRun = state.LastError, state.MissedRuns, state.LastMissedRun
+	schedule.NextRun = nil
+	if !schedule.Paused {
+		schedule.NextRun, _ = getNextRun(schedule, now)
+	}
+	schedule.UpdatedAt = now
+	if err := storeSchedule(&schedule); err != nil {
+		fmt.Printf("[Schedule] Error storing schedule %s: %v\n", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSchedule(schedule)
+	writeJSONResponse(w, http.StatusOK, schedule)
+	fmt.Printf("[Schedule] Schedule %s stored\n", name)
+}
+
+// ListSchedules lists the schedules by name
+func ListSchedules(w http.ResponseWriter, r *http.Request) {
+	scheduler.Lock()
+	schedules := make([]Schedule, 0, len(scheduler.schedules))
+	for _, schedule := range scheduler.schedules {
+		schedules = append(schedules, *schedule)
+	}
+	scheduler.Unlock()
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Name < schedules[j].Name
+	})
+	writeJSONResponse(w, http.StatusOK, schedules)
+}
+
+// GetSchedule returns the schedule with its run state
+func GetSchedule(w http.ResponseWriter, r *http.Request, name string) {
+	schedule, ok := getSchedule(name)
+	if !ok {
+		http.Error(w, errScheduleNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, schedule)
+}
+
+// DeleteSchedule deletes the schedule. The backups it made are kept.
+func DeleteSchedule(w http.ResponseWriter, r *http.Request, name string) {
+	if err := deleteSchedule(name); err != nil {
+		if errors.Is(err, errScheduleNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]string{"name": name})
+}
+
+// deleteSchedule removes the schedule from the store and from the scheduler
+func deleteSchedule(name string) error {
+	scheduler.writes.Lock()
+	defer scheduler.writes.Unlock()
+	if _, ok := getSchedule(name); !ok {
+		return errScheduleNotFound
+	}
+	if err := store.Delete(getSchedulePath(name)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	scheduler.Lock()
+	delete(scheduler.schedules, name)
+	scheduler.Unlock()
+	fmt.Printf("[Schedule] Schedule %s deleted\n", name)
+	return nil
+}
+
+// deleteAppSchedules deletes the schedules backing up the application and
+// returns their names
+func deleteAppSchedules(appID string) ([]string, error) {
+	var names []string
+	scheduler.Lock()
+	for name, schedule := range scheduler.schedules {
+		if schedule.AppID == appID {
+			names = append(names, name)
+		}
+	}
+	scheduler.Unlock()
+	sort.Strings(names)
+	deletedSchedules := []string{}
+	for _, name := range names {
+		if err := deleteSchedule(name); err != nil && !errors.Is(err, errScheduleNotFound) {
+			return deletedSchedules, fmt.Errorf("error deleting schedule %s: %w", name, err)
+		}
+		deletedSchedules = append(deletedSchedules, name)
+	}
+	return deletedSchedules, nil
+}
+
+// PauseSchedule pauses or resumes the schedule. A resumed schedule runs next
+// at its first time after the resume, the runs skipped while paused are not
+// counted as missed.
+func PauseSchedule(w http.ResponseWriter, r *http.Request, name string, paused bool) {
+	scheduler.writes.Lock()
+	defer scheduler.writes.Unlock()
+	updated, ok := getSchedule(name)
+	if !ok {
+		http.Error(w, errScheduleNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	updated.Paused = paused
+	updated.NextRun = nil
+	if !paused {
+		updated.NextRun, _ = getNextRun(updated, time.Now().UTC())
+	}
+	updated.UpdatedAt = time.Now().UTC()
+	if err := storeSchedule(&updated); err != nil {
+		fmt.Printf("[Schedule] Error storing schedule %s: %v\n", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSchedule(updated)
+	writeJSONResponse(w, http.StatusOK, updated)
+	if paused {
+		fmt.Printf("[Schedule] Schedule %s paused\n", name)
+	} else {
+		fmt.Printf("[Schedule] Schedule %s resumed\n", name)
+	}
+}
+
+// validateSchedule checks the cron expression, the timezone and the backup
+// options of the schedule against its application
+func validateSchedule(schedule Schedule) error {
+	if _, err := getNextRun(schedule, time.Now()); err != nil {
+		return err
+	}
+	if schedule.MissedRun != "" && schedule.MissedRun != MissedRunOnce && schedule.MissedRun != MissedRunSkip {
+		return fmt.Errorf("Invalid missed run policy: %s", schedule.MissedRun)
+	}
+	app, err := readApplication(schedule.AppID)
+	if err != nil {
+		return fmt.Errorf("Application %s not found", schedule.AppID)
+	}
+	_, err = getBackupSpec(*app, schedule.BackupRequest)
+	return err
+}
+
+// parseSchedule parses the cron expression and the timezone of the schedule
+func parseSchedule(schedule Schedule) (cron.Schedule, *time.Location, error) {
+	if strings.HasPrefix(schedule.Cron, "TZ=") || strings.HasPrefix(schedule.Cron, "CRON_TZ=") {
+		return nil, nil, errors.New("Set the timezone of the schedule with the timezone field")
+	}
+	cronSchedule, err := cron.ParseStandard(schedule.Cron)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid cron expression %q: %v", schedule.Cron, err)
+	}
+	if delay, ok := cronSchedule.(cron.ConstantDelaySchedule); ok && delay.Delay < time.Minute {
+		return nil, nil, errors.New("Schedules cannot run more than once a minute")
+	}
+	location := time.UTC
+	if schedule.Timezone != "" {
+		if location, err = time.LoadLocation(schedule.Timezone); err != nil {
+			return nil, nil, fmt.Errorf("Invalid timezone %q: %v", schedule.Timezone, err)
+		}
+	}
+	return cronSchedule, location, nil
+}
+
+// getNextRun returns the first run of the schedule after the given time
+func getNextRun(schedule Schedule, after time.Time) (*time.Time, error) {
+	cronSchedule, location, err := parseSchedule(schedule)
+	if err != nil {
+		return nil, err
+	}
+	next := cronSchedule.Next(after.In(location))
+	if next.IsZero() {
+		return nil, fmt.Errorf("Cron expression %q never matches", schedule.Cron)
+	}
+	next = next.UTC()
+	return &next, nil
+}
+
+// StartScheduler loads the stored schedules and starts the scheduler loop. The
+// runs missed while the tool was down are handled on the first pass.
+func StartScheduler() error {
+	keys, err := store.List(constants.SCHEDULES_DIR)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		schedule, err := readSchedule(key)
+		if err != nil {
+			fmt.Printf("[Schedule] Error reading schedule %s: %v\n", key, err)
+			continue
+		}
+		setSchedule(*schedule)
+	}
+	fmt.Printf("[Schedule] %d schedules loaded\n", len(keys))
+
+	go func() {
+		ticker := time.NewTicker(constants.SCHEDULE_POLL_INTERVAL * time.Second)
+		defer ticker.Stop()
+		runDueSchedules(time.Now().UTC())
+		for now := range ticker.C {
+			runDueSchedules(now.UTC())
+		}
+	}()
+	return nil
+}
+
+// runDueSchedules runs the schedules whose next run has come. The schedules
+// are run from a snapshot, so that the store is not accessed under the map lock.
+func runDueSchedules(now time.Time) {
+	scheduler.Lock()
+	var due []Schedule
+	for _, schedule := range scheduler.schedules {
+		if !schedule.Paused && schedule.NextRun != nil && !now.Before(*schedule.NextRun) {
+			due = append(due, *schedule)
+		}
+	}
+	scheduler.Unlock()
+	for _, schedule := range due {
+		runSchedule(schedule, now)
+	}
+}
+
+// dueRuns are the runs of a schedule that have come
+type dueRuns struct {
+	// Run tells if a backup is to be started
+	Run bool
+	// Missed is the number of runs missed, LastMissed the last of them
+	Missed     int
+	LastMissed time.Time
+}
+
+// getDueRuns returns the runs of the schedule from its next run up to now. A
+// paused schedule has no run due. When the next run is later than the grace
+// period, e.g. because the tool was down, every run since is counted as missed
+// and the missed run policy decides whether a single backup catches up with
+// them.
+func getDueRuns(schedule Schedule, now time.Time) (dueRuns, error) {
+	if schedule.Paused || schedule.NextRun == nil || now.Before(*schedule.NextRun) {
+		return dueRuns{}, nil
+	}
+	cronSchedule, location, err := parseSchedule(schedule)
+	if err != nil {
+		return dueRuns{}, err
+	}
+	if now.Sub(*schedule.NextRun) <= constants.SCHEDULE_MISSED_GRACE*time.Second {
+		return dueRuns{Run: true}, nil
+	}
+	due := dueRuns{Run: schedule.MissedRun != MissedRunSkip}
+	for next := *schedule.NextRun; !next.IsZero() && !next.After(now); next = cronSchedule.Next(next.In(location)) {
+		due.Missed++
+		due.LastMissed = next.UTC()
+	}
+	return due, nil
+}
+
+// runSchedule starts the backup of a due schedule and computes its next run
+func runSchedule(schedule Schedule, now time.Time) {
+	updatedAt := schedule.UpdatedAt
+	due, err := getDueRuns(schedule, now)
+	if err != nil {
+		schedule.LastError = err.Error()
+		schedule.NextRun = nil
+	} else {
+		run := due.Run
+		if due.Missed > 0 {
+			schedule.MissedRuns += due.Missed
+			schedule.LastMissedRun = &due.LastMissed
+			fmt.Printf("[Schedule] Schedule %s missed %d runs since %s\n", schedule.Name, due.Missed, schedule.NextRun.Format(time.RFC3339))
+		}
+		if run && schedule.LastBackupID != "" && isBackupInProgress(schedule.LastBackupID) {
+			// Backups of a schedule never overlap
+			run = false
+			schedule.MissedRuns++
+			schedule.LastMissedRun = &now
+			schedule.LastError = fmt.Sprintf("Run at %s skipped, backup %s is still in progress", now.Format(time.RFC3339), schedule.LastBackupID)
+			fmt.Printf("[Schedule] %s\n", schedule.LastError)
+		}
+		if run {
+			startScheduledBackup(&schedule, now)
+		}
+		schedule.NextRun, _ = getNextRun(schedule, now)
+	}
+	recordScheduleRun(schedule, updatedAt)
+}
+
+// recordScheduleRun stores the run state of the schedule. The schedule may have
+// been replaced, paused or deleted while it ran: a deleted schedule is not
+// stored again, and the next run of a changed one is kept.
+func recordScheduleRun(run Schedule, updatedAt time.Time) {
+	scheduler.writes.Lock()
+	defer scheduler.writes.Unlock()
+	schedule, ok := getSchedule(run.Name)
+	if !ok {
+		return
+	}
+	schedule.LastRun, schedule.LastBackupID, schedule.LastTaskID = run.LastRun, run.LastBackupID, run.LastTaskID
+	schedule.LastError, schedule.MissedRuns, schedule.LastMissedRun = run.LastError, run.MissedRuns, run.LastMissedRun
+	if schedule.UpdatedAt.Equal(updatedAt) {
+		schedule.NextRun = run.NextRun
+	}
+	if err := storeSchedule(&schedule); err != nil {
+		fmt.Printf("[Schedule] Error storing schedule %s: %v\n", schedule.Name, err)
+	}
+	setSchedule(schedule)
+}
+
+// startScheduledBackup starts the backup of the schedule and records the run.
+// Once the backup is done, the retention policy of the application prunes its
+// old backups.
+func startScheduledBackup(schedule *Schedule, now time.Time) {
+	schedule.LastRun = &now
+	schedule.LastBackupID, schedule.LastTaskID, schedule.LastError = "", "", ""
+	app, err := readApplication(schedule.AppID)
+	if err != nil {
+		schedule.LastError = fmt.Sprintf("Application %s not found", schedule.AppID)
+		fmt.Printf("[Schedule] Error running schedule %s: %s\n", schedule.Name, schedule.LastError)
+		return
+	}
+	spec, err := getBackupSpec(*app, schedule.BackupRequest)
+	if err == nil {
+		spec.Schedule = schedule.Name
+		var backupID uuid.UUID
+		if backupID, err = uuid.NewRandom(); err == nil {
+			schedule.LastBackupID = backupID.String()
+			schedule.LastTaskID, err = startBackup(*app, backupID.String(), spec, getBackupTimeout(schedule.BackupRequest), func() {
+				applyRetentionAfterBackup(app.ID)
+			})
+		}
+	}
+	if err != nil {
+		schedule.LastBackupID = ""
+		schedule.LastError = err.Error()
+		fmt.Printf("[Schedule] Error running schedule %s: %v\n", schedule.Name, err)
+		return
+	}
+	fmt.Printf("[Schedule] Schedule %s started backup %s\n", schedule.Name, schedule.LastBackupID)
+}
+
+// getSchedule returns a copy of the schedule
+func getSchedule(name string) (Schedule, bool) {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	schedule, ok := scheduler.schedules[name]
+	if !ok {
+		return Schedule{}, false
+	}
+	return *schedule, true
+}
+
+// setSchedule adds or replaces the schedule in the scheduler
+func setSchedule(schedule Schedule) {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	scheduler.schedules[schedule.Name] = &schedule
+}
+
+// storeSchedule writes the schedule to the store
+func storeSchedule(schedule *Schedule) error {
+	scheduleData, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	return store.Put(getSchedulePath(schedule.Name), scheduleData)
+}
+
+// readSchedule reads a stored schedule by its key
+func readSchedule(key string) (*Schedule, error) {
+	scheduleData, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	var schedule Schedule
+	if err := json.Unmarshal(scheduleData, &schedule); err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func getSchedulePath(name string) string {
+	return storage.Join(constants.SCHEDULES_DIR, name)
+}
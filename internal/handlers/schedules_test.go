@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"testing"
+	"time"
+)
+
+func TestGetDueRuns(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	nextRun := at("2024-03-01T10:00:00Z")
+	hourly := Schedule{Name: "hourly", Cron: "0 * * * *", NextRun: &nextRun}
+	tests := []struct {
+		name     string
+		schedule func(schedule Schedule) Schedule
+		now      string
+		want     dueRuns
+		wantErr  bool
+	}{
+		{
+			name: "next run not yet come",
+			now:  "2024-03-01T09:59:59Z",
+		},
+		{
+			name: "run on time",
+			now:  "2024-03-01T10:00:00Z",
+			want: dueRuns{Run: true},
+		},
+		{
+			// The scheduler polls every few seconds, a late poll within the grace
+			// period misses nothing
+			name: "run within the grace period",
+			now:  "2024-03-01T10:01:00Z",
+			want: dueRuns{Run: true},
+		},
+		{
+			name: "run just after the grace period",
+			now:  "2024-03-01T10:01:01Z",
+			want: dueRuns{Run: true, Missed: 1, LastMissed: at("2024-03-01T10:00:00Z")},
+		},
+		{
+			name: "several missed runs caught up once",
+			now:  "2024-03-01T13:30:00Z",
+			want: dueRuns{Run: true, Missed: 4, LastMissed: at("2024-03-01T13:00:00Z")},
+		},
+		{
+			name: "several missed runs skipped",
+			schedule: func(schedule Schedule) Schedule {
+				schedule.MissedRun = MissedRunSkip
+				return schedule
+			},
+			now:  "2024-03-01T13:30:00Z",
+			want: dueRuns{Missed: 4, LastMissed: at("2024-03-01T13:00:00Z")},
+		},
+		{
+			name: "paused schedule",
+			schedule: func(schedule Schedule) Schedule {
+				schedule.Paused = true
+				return schedule
+			},
+			now: "2024-03-01T13:30:00Z",
+		},
+		{
+			name: "schedule without next run",
+			schedule: func(schedule Schedule) Schedule {
+				schedule.NextRun = nil
+				return schedule
+			},
+			now: "2024-03-01T13:30:00Z",
+		},
+		{
+			// 02:00 in Paris is 01:00 UTC in winter
+			name: "missed runs in the timezone of the schedule",
+			schedule: func(schedule Schedule) Schedule {
+				firstRun := at("2024-01-01T01:00:00Z")
+				schedule.Cron, schedule.Timezone, schedule.NextRun = "0 2 * * *", "Europe/Paris", &firstRun
+				return schedule
+			},
+			now:  "2024-01-03T12:00:00Z",
+			want: dueRuns{Run: true, Missed: 3, LastMissed: at("2024-01-03T01:00:00Z")},
+		},
+		{
+			name: "invalid cron expression",
+			schedule: func(schedule Schedule) Schedule {
+				schedule.Cron = "every hour"
+				return schedule
+			},
+			now:     "2024-03-01T10:00:00Z",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule := hourly
+			if test.schedule != nil {
+				schedule = test.schedule(schedule)
+			}
+			due, err := getDueRuns(schedule, at(test.now))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("getDueRuns error = %v, want error %v", err, test.wantErr)
+			}
+			if due != test.want {
+				t.Errorf("getDueRuns = %+v, want %+v", due, test.want)
+			}
+		})
+	}
+}
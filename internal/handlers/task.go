@@ -1,36 +1,219 @@
 package handlers
 
-//
-//import (
-//	"github.com/arzzon/app-backup-restore/internal/types"
-//	"net/http"
-//	"time"
-//)
-//
-//func TaskHandler(w http.ResponseWriter, r *http.Request) {
-//	switch r.Method {
-//	case http.MethodPost:
-//		StoreAppData(w, r)
-//	default:
-//		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-//	}
-//}
-//
-//// pollTaskStatus polls the status of the backup task and updates it accordingly
-//func pollTaskStatus(task *types.Task) {
-//	// Poll every second until the task is completed or failed
-//	for {
-//		if task.Status == "completed" || task.Status == "failed" {
-//			return
-//		}
-//
-//		// Simulate polling (sleep for 1 second)
-//		time.Sleep(1 * time.Second)
-//
-//		// Check if the backup has taken more than 10 minutes
-//		if time.Since(time.Now()) > 10*time.Minute {
-//			task.Status = "failed"
-//			return
-//		}
-//	}
-//}
+import (
+	"context"
+	"fmt"
+	"github.com/arzzon/app-backup-restore/internal/constants"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// taskStore holds the tasks started since the process came up
+type taskStore struct {
+	mutex   sync.RWMutex
+	tasks   map[string]*Task
+	cancels map[string]context.CancelFunc
+}
+
+var tasks = &taskStore{
+	tasks:   make(map[string]*Task),
+	cancels: make(map[string]context.CancelFunc),
+}
+
+// TaskHandler handles the task status requests
+func TaskHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		GetTaskStatus(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GetTaskStatus returns the status of the task with the ID given in the path,
+// or of all the tasks if no ID is given
+func GetTaskStatus(w http.ResponseWriter, r *http.Request) {
+	taskID := getPathID(r.URL.Path, "/tasks/")
+	if taskID == "" {
+		writeJSONResponse(w, http.StatusOK, listTasks())
+		return
+	}
+	task, found := getTask(taskID)
+	if !found {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, task)
+}
+
+// newTask registers a new in-progress task for the given backup. The returned
+// context is cancelled once the task times out. The tasks that finished longer
+// ago than the expiry delay are forgotten.
+func newTask(taskID, appID, backupID string, timeout time.Duration) (*Task, context.Context) {
+	task := &Task{
+		ID:              taskID,
+		AppID:           appID,
+		BackupID:        backupID,
+		Status:          InProgress,
+		StartTime:       time.Now(),
+		TimeoutDuration: timeout,
+		Progress:        make(map[ResourceKind]TaskStatus),
+		Running:         true,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+	for id, expired := range tasks.tasks {
+		if !expired.Running && expired.Status != InProgress && time.Since(expired.EndTime) > constants.TASK_EXPIRY*time.Second {
+			delete(tasks.tasks, id)
+		}
+	}
+	tasks.tasks[taskID] = task
+	tasks.cancels[taskID] = cancel
+	return task, ctx
+}
+
+// endTask records that the work of the task returned
+func endTask(taskID string) {
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+	if task, ok := tasks.tasks[taskID]; ok {
+		task.Running = false
+	}
+}
+
+// updateTaskProgress updates the status of a resource kind of the task
+func updateTaskProgress(taskID string, kind ResourceKind, status TaskStatus) {
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+	if task, ok := tasks.tasks[taskID]; ok {
+		task.Progress[kind] = status
+	}
+}
+
+// finishTask marks the task as completed or failed. A task that has already
+// finished, e.g. because it timed out, is left untouched.
+func finishTask(taskID string, status TaskStatus, msg string) {
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+	task, ok := tasks.tasks[taskID]
+	if !ok || task.Status != InProgress {
+		return
+	}
+	task.Status = status
+	task.Message = msg
+	task.EndTime = time.Now()
+	if cancel, ok := tasks.cancels[taskID]; ok {
+		cancel()
+		delete(tasks.cancels, taskID)
+	}
+	fmt.Printf("[Task] Task %s %s: %s\n", taskID, status, msg)
+}
+
+// setTaskResult attaches the outcome of the backup to the task
+func setTaskResult(taskID string, result *BackupResponse) {
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+	if task, ok := tasks.tasks[taskID]; ok {
+		task.Result = result
+	}
+}
+
+// getTask returns a snapshot of the task
+func getTask(taskID string) (TaskResponse, bool) {
+	tasks.mutex.RLock()
+	defer tasks.mutex.RUnlock()
+	task, ok := tasks.tasks[taskID]
+	if !ok {
+		return TaskResponse{}, false
+	}
+	return getTaskResponse(task), true
+}
+
+// listTasks returns a snapshot of all the tasks
+func listTasks() []TaskResponse {
+	tasks.mutex.RLock()
+	defer tasks.mutex.RUnlock()
+	taskList := make([]TaskResponse, 0, len(tasks.tasks))
+	for _, task := range tasks.tasks {
+		taskList = append(taskList, getTaskResponse(task))
+	}
+	return taskList
+}
+
+// isBackupInProgress checks if a task is still writing the backup, including a
+// task that timed out but whose work has not returned yet
+func isBackupInProgress(backupID string) bool {
+	tasks.mutex.RLock()
+	defer tasks.mutex.RUnlock()
+	for _, task := range tasks.tasks {
+		if task.BackupID == backupID && (task.Status == InProgress || task.Running) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAppBackupInProgress checks if a task is still writing a backup of the application
+func isAppBackupInProgress(appID string) bool {
+	tasks.mutex.RLock()
+	defer tasks.mutex.RUnlock()
+	for _, task := range tasks.tasks {
+		if task.AppID == appID && (task.Status == InProgress || task.Running) {
+			return true
+		}
+	}
+	return false
+}
+
+// getTaskResponse converts the task to its API representation. The caller must
+// hold the task store lock.
+func getTaskResponse(task *Task) TaskResponse {
+	taskResponse := TaskResponse{
+		ID:        task.ID,
+		AppID:     task.AppID,
+		BackupID:  task.BackupID,
+		Status:    task.Status,
+		Message:   task.Message,
+		StartTime: task.StartTime,
+		Timeout:   task.TimeoutDuration.String(),
+		Result:    task.Result,
+		Progress:  make(map[ResourceKind]TaskStatus, len(task.Progress)),
+	}
+	for kind, status := range task.Progress {
+		taskResponse.Progress[kind] = status
+	}
+	if task.Status == InProgress {
+		taskResponse.Duration = time.Since(task.StartTime).Round(time.Millisecond).String()
+	} else {
+		endTime := task.EndTime
+		taskResponse.EndTime = &endTime
+		taskResponse.Duration = endTime.Sub(task.StartTime).Round(time.Millisecond).String()
+	}
+	return taskResponse
+}
+
+// pollTaskStatus polls the status of the backup task and fails it once it
+// runs longer than its timeout
+func pollTaskStatus(taskID string) {
+	ticker := time.NewTicker(constants.TASK_POLL_INTERVAL * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		tasks.mutex.RLock()
+		task, ok := tasks.tasks[taskID]
+		if !ok || task.Status != InProgress {
+			tasks.mutex.RUnlock()
+			return
+		}
+		timedOut := time.Since(task.StartTime) > task.TimeoutDuration
+		tasks.mutex.RUnlock()
+
+		if timedOut {
+			finishTask(taskID, Failed, "Task timed out")
+			return
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"path"
+	"strings"
+)
+
+// jsonPatchOps are the operations of RFC 6902
+var jsonPatchOps = map[string]bool{"add": true, "remove": true, "replace": true, "move": true, "copy": true, "test": true}
+
+// jsonPatchValueOps are the operations of RFC 6902 that need a value
+var jsonPatchValueOps = map[string]bool{"add": true, "replace": true, "test": true}
+
+// identityPaths are the JSON pointers of the fields identifying an object,
+// which select the endpoint the object is sent to and cannot be transformed
+var identityPaths = []string{"/apiVersion", "/kind", "/metadata/name", "/metadata/namespace"}
+
+// containerFields are the fields holding the containers of a pod spec
+var containerFields = map[string]bool{"containers": true, "initContainers": true, "ephemeralContainers": true}
+
+var errProfileNotFound = errors.New("transform profile not found")
+
+var errTransformFailed = errors.New("transform failed")
+
+// getTransformRules returns the rules of the transform profile of the request
+// followed by those of the request itself
+func getTransformRules(restoreReq RestoreRequest) ([]TransformRule, error) {
+	if err := validateTransformRules(restoreReq.Transforms); err != nil {
+		return nil, err
+	}
+	if restoreReq.TransformProfile == "" {
+		return restoreReq.Transforms, nil
+	}
+	profile, err := readTransformProfile(restoreReq.TransformProfile)
+	if err == errProfileNotFound {
+		return nil, fmt.Errorf("Transform profile %s not found", restoreReq.TransformProfile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading transform profile %s: %v", restoreReq.TransformProfile, err)
+	}
+	return append(append([]TransformRule{}, profile.Rules...), restoreReq.Transforms...), nil
+}
+
+// transform applies the matching transform rules of the restore to the object.
+// The rules cannot change the identity of the object, as its endpoint and
+// target namespace are already resolved.
+func (job *restoreJob) transform(obj *unstructured.Unstructured, kind ResourceKind) error {
+	apiVersion, objKind, namespace, name := obj.GetAPIVersion(), obj.GetKind(), obj.GetNamespace(), obj.GetName()
+	transformed := false
+	for _, rule := range job.Transforms {
+		if !transformRuleMatches(rule, obj, kind) {
+			continue
+		}
+		if err := applyTransformRule(obj, rule); err != nil {
+			return fmt.Errorf("%w for %s %s: %v", errTransformFailed, kind, getObjectKey(obj.GetNamespace(), obj.GetName()), err)
+		}
+		transformed = true
+	}
+	if obj.GetAPIVersion() != apiVersion || obj.GetKind() != objKind || obj.GetNamespace() != namespace || obj.GetName() != name {
+		return fmt.Errorf("%w for %s %s: the apiVersion, kind, namespace and name of an object cannot be transformed", errTransformFailed, kind, getObjectKey(namespace, name))
+	}
+	if transformed {
+		job.Response.Transformed = appendName(job.Response.Transformed, kind, getObjectKey(obj.GetNamespace(), obj.GetName()))
+	}
+	return nil
+}
+
+// transformRuleMatches checks if the object matches the kind, name glob and
+// label selector of the rule
+func transformRuleMatches(rule TransformRule, obj *unstructured.Unstructured, kind ResourceKind) bool {
+	if rule.Kind != "*" && !kindMatches(kind, string(rule.Kind)) {
+		return false
+	}
+	if rule.Name != "" {
+		if matched, _ := path.Match(rule.Name, obj.GetName()); !matched {
+			return false
+		}
+	}
+	// Selectors are checked by validateTransformRules
+	selector, err := labels.Parse(rule.LabelSelector)
+	return err == nil && selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// applyTransformRule applies the merge patch, the JSON patch and the image
+// registry rewrites of the rule to the object
+func applyTransformRule(obj *unstructured.Unstructured, rule TransformRule) error {
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if len(rule.MergePatch) > 0 {
+		patch, err := json.Marshal(rule.MergePatch)
+		if err != nil {
+			return err
+		}
+		// Built-in kinds merge lists such as containers by their merge key
+		if dataStruct, schemeErr := scheme.Scheme.New(obj.GroupVersionKind()); schemeErr == nil {
+			data, err = strategicpatch.StrategicMergePatch(data, patch, dataStruct)
+		} else {
+			data, err = jsonpatch.MergePatch(data, patch)
+		}
+		if err != nil {
+			return fmt.Errorf("merge patch: %v", err)
+		}
+	}
+	if len(rule.JSONPatch) > 0 {
+		patchData, err := json.Marshal(rule.JSONPatch)
+		if err != nil {
+			return err
+		}
+		patch, err := jsonpatch.DecodePatch(patchData)
+		if err != nil {
+			return err
+		}
+		if data, err = patch.Apply(data); err != nil {
+			return fmt.Errorf("JSON patch: %v", err)
+		}
+	}
+
+	patched := &unstructured.Unstructured{}
+	if err := patched.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	if len(rule.ImageRegistries) > 0 {
+		rewriteImages(patched.Object, rule.ImageRegistries)
+	}
+	obj.Object = patched.Object
+	return nil
+}
+
+// rewriteImages replaces the registry hosts of the images of the containers
+// found anywhere in the value, which covers pods and pod templates alike
+func rewriteImages(value interface{}, registries map[string]string) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if containers, ok := field.([]interface{}); ok && containerFields[key] {
+				for _, container := range containers {
+					if container, ok := container.(map[string]interface{}); ok {
+						if image, ok := container["image"].(string); ok {
+							container["image"] = rewriteImage(image, registries)
+						}
+					}
+				}
+				continue
+			}
+			rewriteImages(field, registries)
+		}
+	case []interface{}:
+		for _, item := range value {
+			rewriteImages(item, registries)
+		}
+	}
+}
+
+// rewriteImage replaces the registry host of the image if it is mapped. Images
+// without a registry host come from docker.io.
+func rewriteImage(image string, registries map[string]string) string {
+	registry, repository := "docker.io", image
+	if host, rest, found := strings.Cut(image, "/"); found && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		registry, repository = host, rest
+	} else if !found {
+		repository = "library/" + image
+	}
+	target, ok := registries[registry]
+	if !ok {
+		return image
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(target, "/"), repository)
+}
+
+// validateTransformRules checks that the rules name a kind, valid patterns and
+// selectors, and at least one change
+func validateTransformRules(rules []TransformRule) error {
+	for _, rule := range rules {
+		if rule.Kind == "" {
+			return fmt.Errorf("Transform rule without kind, use \"*\" for every kind")
+		}
+		if err := validateNamePatterns([]string{rule.Name}); err != nil {
+			return err
+		}
+		if _, err := labels.Parse(rule.LabelSelector); err != nil {
+			return fmt.Errorf("Invalid label selector for %s: %v", rule.Kind, err)
+		}
+		if len(rule.MergePatch) == 0 && len(rule.JSONPatch) == 0 && len(rule.ImageRegistries) == 0 {
+			return fmt.Errorf("Transform rule for %s changes nothing", rule.Kind)
+		}
+		if changesIdentity(rule.MergePatch) {
+			return fmt.Errorf("Merge patch for %s cannot change the apiVersion, kind, namespace or name", rule.Kind)
+		}
+		for _, op := range rule.JSONPatch {
+			if !jsonPatchOps[op.Op] {
+				return fmt.Errorf("Invalid JSON patch operation %q for %s", op.Op, rule.Kind)
+			}
+			if op.Path != "" && !strings.HasPrefix(op.Path, "/") {
+				return fmt.Errorf("Invalid JSON patch path %q for %s", op.Path, rule.Kind)
+			}
+			if jsonPatchValueOps[op.Op] && len(op.Value) == 0 {
+				return fmt.Errorf("JSON patch operation %s of %s for %s needs a value", op.Op, op.Path, rule.Kind)
+			}
+			if op.Op != "test" && (touchesIdentity(op.Path) || (op.Op == "move" && touchesIdentity(op.From))) {
+				return fmt.Errorf("JSON patch for %s cannot change %s", rule.Kind, op.Path)
+			}
+		}
+		for registry, target := range rule.ImageRegistries {
+			if registry == "" || target == "" {
+				return fmt.Errorf("Invalid image registry mapping %q to %q for %s", registry, target, rule.Kind)
+			}
+		}
+	}
+	return nil
+}
+
+// touchesIdentity checks if a JSON patch at the pointer changes a field
+// identifying the object, or a field holding one
+func touchesIdentity(pointer string) bool {
+	for _, identityPath := range identityPaths {
+		if pointer == identityPath || strings.HasPrefix(pointer, identityPath+"/") || strings.HasPrefix(identityPath, pointer+"/") {
+			return true
+		}
+	}
+	return pointer == ""
+}
+
+// changesIdentity checks if the merge patch sets a field identifying the object
+func changesIdentity(mergePatch map[string]interface{}) bool {
+	_, hasAPIVersion := mergePatch["apiVersion"]
+	_, hasKind := mergePatch["kind"]
+	metadata, hasMetadata := mergePatch["metadata"]
+	if !hasMetadata {
+		return hasAPIVersion || hasKind
+	}
+	metadataPatch, ok := metadata.(map[string]interface{})
+	if !ok {
+		return true
+	}
+	_, hasName := metadataPatch["name"]
+	_, hasNamespace := metadataPatch["namespace"]
+	return hasAPIVersion || hasKind || hasName || hasNamespace
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/arzzon/app-backup-restore/internal/types"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const transformDeployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata: {name: web, namespace: ns1, labels: {app: web}}
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - {name: app, image: "registry.local:5000/shop/app:1.0"}
+      - {name: sidecar, image: "envoy:1.29"}`
+
+const transformWidget = `
+apiVersion: example.com/v1
+kind: Widget
+metadata: {name: w1, namespace: ns1}
+spec: {size: 3, colors: [red, blue], owner: team-a}`
+
+// decodeTransformRule decodes the rule as it is received in a request
+func decodeTransformRule(t *testing.T, rule string) TransformRule {
+	t.Helper()
+	var transformRule TransformRule
+	if err := json.Unmarshal([]byte(rule), &transformRule); err != nil {
+		t.Fatal(err)
+	}
+	return transformRule
+}
+
+func TestApplyTransformRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		object string
+		rule   string
+		// want maps dot separated fields to their value after the transform,
+		// nil for a field that must be present with a null value
+		want map[string]interface{}
+		// removed are the fields that must be gone
+		removed []string
+	}{
+		{
+			name:   "strategic merge patch merges containers by name",
+			object: transformDeployment,
+			rule:   `{"kind": "Deployment", "mergePatch": {"spec": {"replicas": 1, "template": {"spec": {"containers": [{"name": "sidecar", "image": "envoy:1.30"}]}}}}}`,
+			want: map[string]interface{}{
+				"spec.replicas": int64(1),
+				"spec.template.spec.containers": []interface{}{
+					map[string]interface{}{"name": "app", "image": "registry.local:5000/shop/app:1.0"},
+					map[string]interface{}{"name": "sidecar", "image": "envoy:1.30"},
+				},
+			},
+		},
+		{
+			name:   "JSON merge patch replaces lists and removes null fields",
+			object: transformWidget,
+			rule:   `{"kind": "Widget", "mergePatch": {"spec": {"colors": ["green"], "owner": null}}}`,
+			want: map[string]interface{}{
+				"spec.size":   int64(3),
+				"spec.colors": []interface{}{"green"},
+			},
+			removed: []string{"spec.owner"},
+		},
+		{
+			name:   "JSON patch",
+			object: transformWidget,
+			rule: `{"kind": "Widget", "jsonPatch": [
+				{"op": "replace", "path": "/spec/size", "value": 5},
+				{"op": "add", "path": "/spec/colors/-", "value": "green"},
+				{"op": "remove", "path": "/spec/owner"},
+				{"op": "add", "path": "/metadata/labels", "value": {"restored": "true"}}]}`,
+			want: map[string]interface{}{
+				"spec.size":                int64(5),
+				"spec.colors":              []interface{}{"red", "blue", "green"},
+				"metadata.labels.restored": "true",
+			},
+			removed: []string{"spec.owner"},
+		},
+		{
+			name:   "JSON patch keeps a null value",
+			object: transformWidget,
+			rule:   `{"kind": "Widget", "jsonPatch": [{"op": "replace", "path": "/spec/owner", "value": null}]}`,
+			want:   map[string]interface{}{"spec.owner": nil},
+		},
+		{
+			name:   "image registries",
+			object: transformDeployment,
+			rule:   `{"kind": "Deployment", "imageRegistries": {"registry.local:5000": "mirror.example.com", "docker.io": "mirror.example.com/hub/"}}`,
+			want: map[string]interface{}{
+				"spec.template.spec.containers": []interface{}{
+					map[string]interface{}{"name": "app", "image": "mirror.example.com/shop/app:1.0"},
+					map[string]interface{}{"name": "sidecar", "image": "mirror.example.com/hub/library/envoy:1.29"},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := decodeTransformRule(t, test.rule)
+			if err := validateTransformRules([]TransformRule{rule}); err != nil {
+				t.Fatalf("validateTransformRules: %v", err)
+			}
+			obj, err := parseObject([]byte(test.object))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := applyTransformRule(obj, rule); err != nil {
+				t.Fatalf("applyTransformRule: %v", err)
+			}
+			for field, want := range test.want {
+				got, found, err := unstructured.NestedFieldNoCopy(obj.Object, strings.Split(field, ".")...)
+				if err != nil || !found {
+					t.Errorf("%s is missing", field)
+					continue
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %#v, want %#v", field, got, want)
+				}
+			}
+			for _, field := range test.removed {
+				if _, found, _ := unstructured.NestedFieldNoCopy(obj.Object, strings.Split(field, ".")...); found {
+					t.Errorf("%s was kept", field)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateTransformRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr string
+	}{
+		{"merge patch", `{"kind": "Deployment", "mergePatch": {"spec": {"replicas": 1}}}`, ""},
+		{"JSON patch with a null value", `{"kind": "*", "jsonPatch": [{"op": "add", "path": "/spec/owner", "value": null}]}`, ""},
+		{"JSON patch testing the name", `{"kind": "*", "jsonPatch": [{"op": "test", "path": "/metadata/name", "value": "web"}]}`, ""},
+		{"JSON patch setting a label", `{"kind": "*", "jsonPatch": [{"op": "add", "path": "/metadata/labels/env", "value": "dr"}]}`, ""},
+		{"rule without kind", `{"mergePatch": {"spec": {"replicas": 1}}}`, "without kind"},
+		{"rule without change", `{"kind": "Deployment"}`, "changes nothing"},
+		{"merge patch renaming the object", `{"kind": "*", "mergePatch": {"metadata": {"name": "web-2"}}}`, "cannot change"},
+		{"merge patch moving the namespace", `{"kind": "*", "mergePatch": {"metadata": {"namespace": "ns2"}}}`, "cannot change"},
+		{"merge patch changing the kind", `{"kind": "*", "mergePatch": {"kind": "StatefulSet"}}`, "cannot change"},
+		{"merge patch replacing the metadata", `{"kind": "*", "mergePatch": {"metadata": null}}`, "cannot change"},
+		{"JSON patch renaming the object", `{"kind": "*", "jsonPatch": [{"op": "replace", "path": "/metadata/name", "value": "web-2"}]}`, "cannot change"},
+		{"JSON patch moving the namespace", `{"kind": "*", "jsonPatch": [{"op": "add", "path": "/metadata/namespace", "value": "ns2"}]}`, "cannot change"},
+		{"JSON patch changing the kind", `{"kind": "*", "jsonPatch": [{"op": "replace", "path": "/kind", "value": "StatefulSet"}]}`, "cannot change"},
+		{"JSON patch removing the metadata", `{"kind": "*", "jsonPatch": [{"op": "remove", "path": "/metadata"}]}`, "cannot change"},
+		{"JSON patch replacing the whole object", `{"kind": "*", "jsonPatch": [{"op": "replace", "path": "", "value": {}}]}`, "cannot change"},
+		{"JSON patch moving the name away", `{"kind": "*", "jsonPatch": [{"op": "move", "from": "/metadata/name", "path": "/spec/name"}]}`, "cannot change"},
+		{"JSON patch without value", `{"kind": "*", "jsonPatch": [{"op": "add", "path": "/spec/owner"}]}`, "needs a value"},
+		{"invalid JSON patch operation", `{"kind": "*", "jsonPatch": [{"op": "merge", "path": "/spec"}]}`, "Invalid JSON patch operation"},
+		{"relative JSON patch path", `{"kind": "*", "jsonPatch": [{"op": "remove", "path": "spec"}]}`, "Invalid JSON patch path"},
+		{"empty image registry", `{"kind": "*", "imageRegistries": {"docker.io": ""}}`, "Invalid image registry"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateTransformRules([]TransformRule{decodeTransformRule(t, test.rule)})
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("validateTransformRules: %v", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("validateTransformRules = %v, want an error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestTransformRejectsIdentityChanges(t *testing.T) {
+	// Rules are validated when the restore is requested, the transform checks
+	// the outcome again
+	rules := map[string]TransformRule{
+		"name":      {Kind: "*", MergePatch: map[string]interface{}{"metadata": map[string]interface{}{"name": "web-2"}}},
+		"namespace": {Kind: "*", JSONPatch: []JSONPatchOperation{{Op: "replace", Path: "/metadata/namespace", Value: json.RawMessage(`"ns2"`)}}},
+		"kind":      {Kind: "*", JSONPatch: []JSONPatchOperation{{Op: "replace", Path: "/kind", Value: json.RawMessage(`"Gadget"`)}}},
+	}
+	for name, rule := range rules {
+		t.Run(name, func(t *testing.T) {
+			obj, err := parseObject([]byte(transformWidget))
+			if err != nil {
+				t.Fatal(err)
+			}
+			job := &restoreJob{Transforms: []TransformRule{rule}, Response: &RestoreResponse{}}
+			if err := job.transform(obj, "Widget.example.com"); !errors.Is(err, errTransformFailed) {
+				t.Errorf("transform = %v, want %v", err, errTransformFailed)
+			}
+			if len(job.Response.Transformed) != 0 {
+				t.Errorf("object reported as transformed: %v", job.Response.Transformed)
+			}
+		})
+	}
+}
+
+func TestRewriteImage(t *testing.T) {
+	registries := map[string]string{
+		"docker.io":           "mirror.example.com/hub",
+		"registry.local:5000": "mirror.example.com",
+		"quay.io":             "mirror.example.com/quay/",
+		"localhost":           "registry.example.com",
+	}
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"nginx", "mirror.example.com/hub/library/nginx"},
+		{"nginx:1.25", "mirror.example.com/hub/library/nginx:1.25"},
+		{"bitnami/mariadb:11", "mirror.example.com/hub/bitnami/mariadb:11"},
+		{"docker.io/bitnami/mariadb:11", "mirror.example.com/hub/bitnami/mariadb:11"},
+		{"registry.local:5000/shop/app", "mirror.example.com/shop/app"},
+		{"registry.local:5000/shop/app:1.0", "mirror.example.com/shop/app:1.0"},
+		{"registry.local:5001/shop/app:1.0", "registry.local:5001/shop/app:1.0"},
+		{"quay.io/prometheus/node-exporter@sha256:0123abcd", "mirror.example.com/quay/prometheus/node-exporter@sha256:0123abcd"},
+		{"nginx@sha256:0123abcd", "mirror.example.com/hub/library/nginx@sha256:0123abcd"},
+		{"localhost/app:dev", "registry.example.com/app:dev"},
+		{"gcr.io/distroless/static", "gcr.io/distroless/static"},
+	}
+	for _, test := range tests {
+		if got := rewriteImage(test.image, registries); got != test.want {
+			t.Errorf("rewriteImage(%s) = %s, want %s", test.image, got, test.want)
+		}
+	}
+}
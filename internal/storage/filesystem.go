@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Filesystem stores the objects as files under a root directory
+type Filesystem struct {
+	Root string
+}
+
+// NewFilesystem returns a filesystem storage rooted at the directory, which is
+// created if it does not exist
+func NewFilesystem(root string) (*Filesystem, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("error creating store root %s: %v", root, err)
+	}
+	return &Filesystem{Root: root}, nil
+}
+
+// Put writes the object, creating its parent directories
+func (store *Filesystem) Put(key string, data []byte) error {
+	filePath, err := store.getPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0644)
+}
+
+// Get reads the object
+func (store *Filesystem) Get(key string) ([]byte, error) {
+	filePath, err := store.getPath(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return data, err
+}
+
+// List walks the directory of the prefix. A prefix without a directory has no objects.
+func (store *Filesystem) List(prefix string) ([]string, error) {
+	dirPath := store.Root
+	if prefix != "" {
+		var err error
+		if dirPath, err = store.getPath(prefix); err != nil {
+			return nil, err
+		}
+	}
+	var keys []string
+	err := filepath.WalkDir(dirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(store.Root, path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(relPath))
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the object along with the directories it leaves empty
+func (store *Filesystem) Delete(key string) error {
+	filePath, err := store.getPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		return err
+	}
+	root := filepath.Clean(store.Root)
+	for dir := filepath.Dir(filePath); dir != root && dir != "."; dir = filepath.Dir(dir) {
+		// Fails on the first directory that still has entries
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Stat returns the size and modification time of the object
+func (store *Filesystem) Stat(key string) (*ObjectInfo, error) {
+	filePath, err := store.getPath(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && info.IsDir()) {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// getPath returns the path of the file of the key
+func (store *Filesystem) getPath(key string) (string, error) {
+	if err := ValidateKey(key); err != nil {
+		return "", fmt.Errorf("%q: %w", key, err)
+	}
+	return filepath.Join(store.Root, filepath.FromSlash(key)), nil
+}
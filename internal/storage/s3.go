@@ -0,0 +1,431 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Service        = "s3"
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3AmzDateFormat  = "20060102T150405Z"
+	s3DateFormat     = "20060102"
+	s3RequestTimeout = 60 * time.Second
+)
+
+// S3Config configures the storage in an S3-compatible bucket
+type S3Config struct {
+	// Endpoint is the URL of the S3 API, e.g. https://s3.eu-west-1.amazonaws.com
+	// or http://minio:9000
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to every key, to share a bucket with other data
+	Prefix string
+	// PathStyle addresses the bucket in the path rather than in the host name,
+	// which most S3-compatible servers require
+	PathStyle bool
+	// The credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+	// and AWS_SESSION_TOKEN environment variables when they are not set, then
+	// from the profile of the shared credentials file
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	CredentialsFile string
+	Profile         string
+}
+
+// S3 stores the objects in an S3-compatible bucket, speaking the S3 REST API
+// with Signature Version 4
+type S3 struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// s3ListResult is the response of a ListObjectsV2 request
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// s3Error is the error document returned by S3
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// NewS3 returns an S3 storage for the bucket, loading the credentials that are
+// not part of the configuration
+func NewS3(config S3Config) (*S3, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("S3 endpoint and bucket are required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Prefix = strings.Trim(config.Prefix, "/")
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+	if err := config.loadCredentials(); err != nil {
+		return nil, err
+	}
+	return &S3{config: config, endpoint: endpoint, client: &http.Client{Timeout: s3RequestTimeout}}, nil
+}
+
+// Put uploads the object
+func (store *S3) Put(key string, data []byte) error {
+	if err := ValidateKey(key); err != nil {
+		return fmt.Errorf("%q: %w", key, err)
+	}
+	resp, err := store.do(http.MethodPut, store.getObjectKey(key), nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkS3Response(resp, key)
+}
+
+// Get downloads the object
+func (store *S3) Get(key string) ([]byte, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, fmt.Errorf("%q: %w", key, err)
+	}
+	resp, err := store.do(http.MethodGet, store.getObjectKey(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkS3Response(resp, key); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// List pages through the objects under the prefix with ListObjectsV2
+func (store *S3) List(prefix string) ([]string, error) {
+	listPrefix := store.getObjectKey(prefix)
+	if listPrefix != "" {
+		listPrefix += "/"
+	}
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {listPrefix}}
+	for {
+		resp, err := store.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = checkS3Response(resp, prefix)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, store.getStoreKey(object.Key))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the object. S3 does not tell whether the object existed, so
+// deleting a missing object succeeds.
+func (store *S3) Delete(key string) error {
+	if err := ValidateKey(key); err != nil {
+		return fmt.Errorf("%q: %w", key, err)
+	}
+	resp, err := store.do(http.MethodDelete, store.getObjectKey(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkS3Response(resp, key)
+}
+
+// Stat returns the size and modification time of the object
+func (store *S3) Stat(key string) (*ObjectInfo, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, fmt.Errorf("%q: %w", key, err)
+	}
+	resp, err := store.do(http.MethodHead, store.getObjectKey(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkS3Response(resp, key); err != nil {
+		return nil, err
+	}
+	info := &ObjectInfo{Key: key}
+	info.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+// getObjectKey returns the key of the object in the bucket
+func (store *S3) getObjectKey(key string) string {
+	if store.config.Prefix == "" {
+		return key
+	}
+	if key == "" {
+		return store.config.Prefix
+	}
+	return store.config.Prefix + "/" + key
+}
+
+// getStoreKey returns the key of the object in the store, given its key in the bucket
+func (store *S3) getStoreKey(objectKey string) string {
+	if store.config.Prefix == "" {
+		return objectKey
+	}
+	return strings.TrimPrefix(objectKey, store.config.Prefix+"/")
+}
+
+// do sends a signed request for the object, or for the bucket when the object
+// key is empty
+func (store *S3) do(method, objectKey string, query url.Values, body []byte) (*http.Response, error) {
+	requestURL := *store.endpoint
+	basePath := strings.TrimSuffix(requestURL.Path, "/")
+	if store.config.PathStyle {
+		basePath += "/" + store.config.Bucket
+	} else {
+		requestURL.Host = store.config.Bucket + "." + requestURL.Host
+	}
+	requestURL.Path = basePath + "/" + objectKey
+	requestURL.RawPath = s3EncodePath(requestURL.Path)
+	requestURL.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, requestURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	store.sign(req, body, time.Now().UTC())
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3 %s %s: %v", method, objectKey, err)
+	}
+	return resp, nil
+}
+
+// sign adds the Signature Version 4 authorization of the request
+func (store *S3) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format(s3AmzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if store.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", store.config.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lowerName := strings.ToLower(name); strings.HasPrefix(lowerName, "x-amz-") {
+			headers[lowerName] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join([]string{now.Format(s3DateFormat), store.config.Region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	signingKey := s3HMAC([]byte("AWS4"+store.config.SecretAccessKey), now.Format(s3DateFormat))
+	signingKey = s3HMAC(signingKey, store.config.Region)
+	signingKey = s3HMAC(signingKey, s3Service)
+	signingKey = s3HMAC(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, store.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// loadCredentials fills the credentials missing from the configuration from
+// the environment, then from the shared credentials file
+func (config *S3Config) loadCredentials() error {
+	if config.AccessKeyID == "" && config.SecretAccessKey == "" {
+		config.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		config.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if config.SessionToken == "" {
+			config.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+	}
+	if config.AccessKeyID != "" && config.SecretAccessKey != "" {
+		return nil
+	}
+
+	credentialsFile := config.CredentialsFile
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if credentialsFile == "" {
+		credentialsFile = filepath.Join(os.Getenv("HOME"), ".aws", "credentials")
+	}
+	profile := config.Profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	values, err := readCredentialsFile(credentialsFile, profile)
+	if err != nil {
+		return fmt.Errorf("no S3 credentials in the environment, and %v", err)
+	}
+	config.AccessKeyID = values["aws_access_key_id"]
+	config.SecretAccessKey = values["aws_secret_access_key"]
+	config.SessionToken = values["aws_session_token"]
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return fmt.Errorf("profile %s of %s has no S3 credentials", profile, credentialsFile)
+	}
+	return nil
+}
+
+// readCredentialsFile returns the keys of the profile in an INI file laid out
+// as the AWS shared credentials file
+func readCredentialsFile(credentialsFile, profile string) (map[string]string, error) {
+	file, err := os.Open(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading credentials file: %v", err)
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	found := false
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			found = found || section == profile
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		if name, value, ok := strings.Cut(line, "="); ok {
+			values[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading credentials file: %v", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("profile %s not found in %s", profile, credentialsFile)
+	}
+	return values, nil
+}
+
+// checkS3Response turns the error responses of S3 into errors, with missing
+// objects reported as ErrNotFound, by status or by NoSuchKey error code
+func checkS3Response(resp *http.Response, key string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	var s3Err s3Error
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		if s3Err.Code == "NoSuchKey" {
+			return fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		return fmt.Errorf("S3 %s %s: %s: %s", resp.Request.Method, key, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("S3 %s %s: %s", resp.Request.Method, key, resp.Status)
+}
+
+// s3EncodePath URI encodes every segment of the path as Signature Version 4
+// expects, keeping the slashes
+func s3EncodePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Encode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery encodes the query with its parameters sorted by name
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Encode(name)+"="+s3Encode(value))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// s3Encode percent-encodes every byte but the unreserved characters of RFC 3986
+func s3Encode(value string) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned for keys that have no object
+var ErrNotFound = errors.New("object not found")
+
+// ErrInvalidKey is returned for keys that are not clean relative paths
+var ErrInvalidKey = errors.New("invalid key")
+
+// Storage persists objects under slash separated keys such as
+// backups/<backup-id>/manifest.json. Backends only need to store flat keys,
+// directories are implied by the keys.
+type Storage interface {
+	// Put creates or replaces the object
+	Put(key string, data []byte) error
+	// Get returns the contents of the object
+	Get(key string) ([]byte, error)
+	// List returns the sorted keys of the objects under the prefix, at any depth
+	List(prefix string) ([]string, error)
+	// Delete removes the object
+	Delete(key string) error
+	// Stat returns the metadata of the object
+	Stat(key string) (*ObjectInfo, error)
+}
+
+// ObjectInfo is the metadata of a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Exists checks if there is an object under the key
+func Exists(store Storage, key string) bool {
+	_, err := store.Stat(key)
+	return err == nil
+}
+
+// HasPrefix checks if there is any object under the prefix
+func HasPrefix(store Storage, prefix string) bool {
+	keys, err := store.List(prefix)
+	return err == nil && len(keys) > 0
+}
+
+// ListChildren returns the sorted names directly under the prefix, which are
+// either objects or prefixes of further objects
+func ListChildren(store Storage, prefix string) ([]string, error) {
+	keys, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var children []string
+	for _, key := range keys {
+		child, _, _ := strings.Cut(strings.TrimPrefix(key, prefix+"/"), "/")
+		if !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+// DeletePrefix removes every object under the prefix
+func DeletePrefix(store Storage, prefix string) error {
+	keys, err := store.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Join joins the elements of a key
+func Join(elems ...string) string {
+	return path.Join(elems...)
+}
+
+// ValidateKey checks that the key is a clean relative path that stays within
+// the store
+func ValidateKey(key string) error {
+	if key == "" || path.Clean(key) != key || path.IsAbs(key) || key == ".." || strings.HasPrefix(key, "../") {
+		return ErrInvalidKey
+	}
+	return nil
+}
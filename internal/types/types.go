@@ -1,50 +1,545 @@
 package types
 
 import (
-	"github.com/golang/protobuf/ptypes/timestamp"
+	"encoding/json"
 	"time"
 )
 
 type Application struct {
-	Namespace string `json:"namespace"`
-	Name      string `json:"name"`
+	ID        string `json:"id,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// Namespaces lists the namespaces of an application spanning several of
+	// them, in place of Namespace
+	Namespaces []string `json:"namespaces,omitempty"`
+	Name       string   `json:"name"`
+	// LabelSelector and FieldSelector restrict the backup to the matching
+	// objects of the namespace, e.g. "app=mariadb"
+	LabelSelector string `json:"labelSelector,omitempty"`
+	FieldSelector string `json:"fieldSelector,omitempty"`
+	// Mode is the default backup mode of the application
+	Mode BackupMode `json:"mode,omitempty"`
+	// IncludedKinds restricts the backup to the given kinds, ExcludedKinds
+	// leaves kinds out and ExcludedNames leaves out the objects matching glob
+	// patterns such as "default-token-*" or "Secret/default-token-*"
+	IncludedKinds []ResourceKind `json:"includedKinds,omitempty"`
+	ExcludedKinds []ResourceKind `json:"excludedKinds,omitempty"`
+	ExcludedNames []string       `json:"excludedNames,omitempty"`
+	// SanitizeRules remove fields from the objects in addition to the built-in rules
+	SanitizeRules []SanitizeRule `json:"sanitizeRules,omitempty"`
+	// Encryption chooses the objects encrypted in the backups when a master key
+	// is configured, Secrets by default
+	Encryption EncryptionScope `json:"encryption,omitempty"`
+	// Retention selects the backups kept by the garbage collection, all of
+	// them when unset
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+	// PreHooks run in the application pods before the resources are backed
+	// up, PostHooks once the namespaced resources are stored
+	PreHooks  []BackupHook `json:"preHooks,omitempty"`
+	PostHooks []BackupHook `json:"postHooks,omitempty"`
+	Version   int          `json:"version,omitempty"`
+	CreatedAt time.Time    `json:"createdAt,omitempty"`
+	UpdatedAt time.Time    `json:"updatedAt,omitempty"`
+}
+
+// enums for the phase of a backup hook
+type HookPhase string
+
+const (
+	PreBackupHook  HookPhase = "pre"
+	PostBackupHook HookPhase = "post"
+)
+
+// enums for the handling of a failed backup hook
+type HookErrorPolicy string
+
+const (
+	// HookFail fails the backup, a failing pre-backup hook aborting it
+	HookFail     HookErrorPolicy = "fail"
+	HookContinue HookErrorPolicy = "continue"
+)
+
+// BackupHook runs a command through the pods/exec subresource in a container
+// of every running pod matching the selector. Each run is its own exec session
+// ending with the command, so a pre-backup hook cannot hold a lock tied to its
+// session, such as a database connection, while the backup runs.
+type BackupHook struct {
+	Name string `json:"name"`
+	// Namespace restricts the hook to one of the application namespaces
+	Namespace   string `json:"namespace,omitempty"`
+	PodSelector string `json:"podSelector"`
+	// Container defaults to the first container of the pod
+	Container      string          `json:"container,omitempty"`
+	Command        []string        `json:"command"`
+	TimeoutSeconds int             `json:"timeoutSeconds,omitempty"`
+	OnError        HookErrorPolicy `json:"onError,omitempty"`
+}
+
+// HookResult records the run of a backup hook in a pod
+type HookResult struct {
+	Hook      string    `json:"hook"`
+	Phase     HookPhase `json:"phase"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod,omitempty"`
+	Container string    `json:"container,omitempty"`
+	StartTime time.Time `json:"startTime"`
+	Duration  string    `json:"duration"`
+	// ExitCode is unset when the command could not be run to completion
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// RetentionPolicy selects the backups of an application kept by the garbage
+// collection. A backup is kept when any keep rule selects it, but never once
+// older than MaxAgeDays. Days, weeks and months are counted in UTC.
+type RetentionPolicy struct {
+	KeepLast    int `json:"keepLast,omitempty"`
+	KeepDaily   int `json:"keepDaily,omitempty"`
+	KeepWeekly  int `json:"keepWeekly,omitempty"`
+	KeepMonthly int `json:"keepMonthly,omitempty"`
+	MaxAgeDays  int `json:"maxAgeDays,omitempty"`
+}
+
+// RetentionReport lists the backups pruned by a garbage collection, or that
+// would be by a dry run, and why the others are kept
+type RetentionReport struct {
+	DryRun bool                `json:"dryRun"`
+	Time   time.Time           `json:"time"`
+	Pruned []RetentionDecision `json:"pruned"`
+	Kept   []RetentionDecision `json:"kept"`
+	// Errors maps the IDs of the backups that could not be pruned to the error
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// RetentionDecision gives the reasons for keeping or pruning a backup
+type RetentionDecision struct {
+	BackupID  string    `json:"backupId"`
+	AppID     string    `json:"app"`
+	Timestamp time.Time `json:"timestamp"`
+	Reasons   []string  `json:"reasons"`
+}
+
+// enums for the objects encrypted in a backup
+type EncryptionScope string
+
+const (
+	EncryptSecrets EncryptionScope = "secrets"
+	EncryptAll     EncryptionScope = "all"
+)
+
+// BackupEncryption records the data key encrypting the objects of a backup,
+// wrapped by the master key of the ID
+type BackupEncryption struct {
+	Scope       EncryptionScope `json:"scope"`
+	MasterKeyID string          `json:"masterKeyId"`
+	WrappedKey  []byte          `json:"wrappedKey"`
+}
+
+// KeyRotationResponse lists the backups whose data key was wrapped again by
+// the new master key, and those that could not be
+type KeyRotationResponse struct {
+	MasterKeyID string            `json:"masterKeyId"`
+	Rewrapped   []string          `json:"rewrapped"`
+	Errors      map[string]string `json:"errors,omitempty"`
+}
+
+// enums for backup mode
+type BackupMode string
+
+const (
+	// TypedMode backs up the fixed list of resource kinds in AllResources
+	TypedMode BackupMode = "typed"
+	// DiscoveryMode backs up every namespaced, listable API resource, CRs included
+	DiscoveryMode BackupMode = "discovery"
+)
+
+// enums for the phase in which a sanitize rule applies
+type SanitizePhase string
+
+const (
+	SanitizeBackup  SanitizePhase = "backup"
+	SanitizeRestore SanitizePhase = "restore"
+	SanitizeBoth    SanitizePhase = "both"
+)
+
+// SanitizeRule removes server-populated or cluster-specific fields from the
+// objects of a kind, when they are backed up, restored or both
+type SanitizeRule struct {
+	// Kind is the resource kind the rule applies to, "*" for every kind
+	Kind  ResourceKind  `json:"kind"`
+	Phase SanitizePhase `json:"phase"`
+	// Fields are dot separated paths such as spec.clusterIP
+	Fields      []string `json:"fields,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
 }
 
 type BackupRequest struct {
 	AppID string `json:"app"`
+	// Mode overrides the backup mode of the application
+	Mode BackupMode `json:"mode,omitempty"`
+	// IncludedKinds overrides those of the application, while ExcludedKinds and
+	// ExcludedNames add to those of the application
+	IncludedKinds []ResourceKind `json:"includedKinds,omitempty"`
+	ExcludedKinds []ResourceKind `json:"excludedKinds,omitempty"`
+	ExcludedNames []string       `json:"excludedNames,omitempty"`
+	// TimeoutSeconds overrides the default timeout of the backup task
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
 }
 
 type BackupResponse struct {
-	AppID    string `json:"app"`
-	BackupID string `json:"backupId"`
-	Message  string `json:"message"`
+	AppID       string         `json:"app"`
+	BackupID    string         `json:"backupId"`
+	TaskID      string         `json:"taskId,omitempty"`
+	Status      BackupStatus   `json:"status,omitempty"`
+	FailedKinds []ResourceKind `json:"failedKinds,omitempty"`
+	Message     string         `json:"message"`
+}
+
+// enums for backup status
+type BackupStatus string
+
+const (
+	BackupCompleted       BackupStatus = "completed"
+	BackupPartiallyFailed BackupStatus = "partially-failed"
+	BackupFailed          BackupStatus = "failed"
+)
+
+// ObjectError is an error hit while backing up a resource kind. Name is empty
+// when the error is not specific to a single object, e.g. a failed List call.
+// Like everywhere in reports, manifests and restore responses, namespaced
+// objects of backups keyed by namespace are named namespace/name.
+type ObjectError struct {
+	Name  string `json:"name,omitempty"`
+	Error string `json:"error"`
+}
+
+// KindReport is the outcome of backing up a single resource kind
+type KindReport struct {
+	Count int `json:"count"`
+	// Excluded lists the objects left out by the name patterns
+	Excluded []string      `json:"excluded,omitempty"`
+	Errors   []ObjectError `json:"errors,omitempty"`
+}
+
+// BackupReport is the outcome of a backup, persisted inside the backup directory
+type BackupReport struct {
+	BackupID    string                       `json:"backupId"`
+	AppID       string                       `json:"app"`
+	Status      BackupStatus                 `json:"status"`
+	FailedKinds []ResourceKind               `json:"failedKinds,omitempty"`
+	Kinds       map[ResourceKind]*KindReport `json:"kinds"`
+	// Errors are the errors not specific to a kind, e.g. failed discovery
+	Errors []string `json:"errors,omitempty"`
+	// Hooks are the runs of the backup hooks in each pod
+	Hooks []HookResult `json:"hooks,omitempty"`
+}
+
+// BackupManifest describes a backup and is stored next to its YAML files
+type BackupManifest struct {
+	BackupID   string `json:"backupId"`
+	AppID      string `json:"app"`
+	AppVersion int    `json:"appVersion,omitempty"`
+	Namespace  string `json:"namespace"`
+	// Namespaces are the namespaces backed up, each in its own directory.
+	// Backups without them hold the objects of Namespace at the top level.
+	Namespaces        []string       `json:"namespaces,omitempty"`
+	LabelSelector     string         `json:"labelSelector,omitempty"`
+	FieldSelector     string         `json:"fieldSelector,omitempty"`
+	Mode              BackupMode     `json:"mode"`
+	ClusterServer     string         `json:"clusterServer"`
+	KubernetesVersion string         `json:"kubernetesVersion"`
+	Timestamp         time.Time      `json:"timestamp"`
+	ToolVersion       string         `json:"toolVersion"`
+	Kinds             []ResourceKind `json:"kinds"`
+	// Schedule is the name of the schedule that started the backup, if any
+	Schedule string `json:"schedule,omitempty"`
+	// ExcludedKinds and ExcludedNames record what was intentionally left out
+	ExcludedKinds []ResourceKind       `json:"excludedKinds,omitempty"`
+	ExcludedNames []string             `json:"excludedNames,omitempty"`
+	ObjectCounts  map[ResourceKind]int `json:"objectCounts"`
+	// SanitizeRules are the rules of the application, applied again on restore
+	SanitizeRules []SanitizeRule `json:"sanitizeRules,omitempty"`
+	// ClusterScoped lists the names of the backed up cluster-scoped objects of
+	// each kind, such as the PersistentVolumes bound to the application's claims
+	ClusterScoped map[ResourceKind][]string `json:"clusterScoped,omitempty"`
+	// OwnedObjects lists the names of the backed up objects of each kind whose
+	// owner references point to another backed up object
+	OwnedObjects map[ResourceKind][]string `json:"ownedObjects,omitempty"`
+	// Encryption is set when objects of the backup are encrypted
+	Encryption *BackupEncryption `json:"encryption,omitempty"`
+	// Pinned backups are never pruned, backups under legal hold cannot be
+	// deleted at all
+	Pinned    bool `json:"pinned,omitempty"`
+	LegalHold bool `json:"legalHold,omitempty"`
+	// Checksums maps the path of each YAML file, relative to the backup
+	// directory, to its SHA-256
+	Checksums map[string]string `json:"checksums"`
+}
+
+// BackupSummary is the listing entry of a backup
+type BackupSummary struct {
+	BackupID          string               `json:"backupId"`
+	AppID             string               `json:"app"`
+	Namespace         string               `json:"namespace"`
+	Namespaces        []string             `json:"namespaces,omitempty"`
+	ClusterServer     string               `json:"clusterServer"`
+	KubernetesVersion string               `json:"kubernetesVersion"`
+	Timestamp         time.Time            `json:"timestamp"`
+	ToolVersion       string               `json:"toolVersion"`
+	Schedule          string               `json:"schedule,omitempty"`
+	Status            BackupStatus         `json:"status,omitempty"`
+	ObjectCounts      map[ResourceKind]int `json:"objectCounts"`
+	Pinned            bool                 `json:"pinned,omitempty"`
+	LegalHold         bool                 `json:"legalHold,omitempty"`
+	// Unverified is set for backups taken before backups had a manifest
+	Unverified bool `json:"unverified,omitempty"`
+}
+
+// BackupHoldRequest pins or unpins a backup and sets or lifts its legal hold,
+// the flags left out are unchanged
+type BackupHoldRequest struct {
+	Pinned    *bool `json:"pinned,omitempty"`
+	LegalHold *bool `json:"legalHold,omitempty"`
+}
+
+// BackupDetails describes a backup along with the objects it holds
+type BackupDetails struct {
+	Manifest *BackupManifest `json:"manifest"`
+	Report   *BackupReport   `json:"report,omitempty"`
+	// Unverified is set for backups taken before backups had a manifest, whose
+	// manifest is built from their files
+	Unverified bool `json:"unverified,omitempty"`
+	// Inventory lists the names of the backed up objects of each kind
+	Inventory map[ResourceKind][]string `json:"inventory"`
 }
 
 type RestoreRequest struct {
-	Namespace string `json:"namespace"`
+	// Namespace is the target namespace of a single namespace backup
+	Namespace string `json:"namespace,omitempty"`
 	BackupID  string `json:"backupId"`
+	// NamespaceMapping maps source namespaces to target namespaces. Namespaces
+	// not mapped are restored in place.
+	NamespaceMapping map[string]string `json:"namespaceMapping,omitempty"`
+	// RestoreOwnedObjects re-creates the objects owned by other backed up
+	// objects too, which are otherwise left to their controllers
+	RestoreOwnedObjects bool `json:"restoreOwnedObjects,omitempty"`
+	// ConflictPolicy decides what happens to objects that already exist,
+	// skip by default
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+	// RenameSuffix is appended to the names of conflicting objects with the
+	// rename policy, "-restored" by default
+	RenameSuffix string `json:"renameSuffix,omitempty"`
+	// DryRun runs every object through a server-side dry run and returns the
+	// plan of the restore without changing the cluster
+	DryRun bool `json:"dryRun,omitempty"`
+	// WaitForReady waits for the restored Deployments, StatefulSets, PVCs and
+	// Pods to become ready, for ReadyTimeoutSeconds or 5 minutes by default
+	WaitForReady        bool `json:"waitForReady,omitempty"`
+	ReadyTimeoutSeconds int  `json:"readyTimeoutSeconds,omitempty"`
+	// Atomic deletes the objects created by the restore when it fails. It
+	// cannot be combined with the overwrite conflict policy.
+	Atomic bool `json:"atomic,omitempty"`
+	// NamespaceOverrides are merged into the labels and annotations of the
+	// target namespaces created by the restore, keyed by target namespace
+	NamespaceOverrides map[string]NamespaceOverride `json:"namespaceOverrides,omitempty"`
+	// TransformProfile names a stored set of transform rules, applied before
+	// the Transforms of the request
+	TransformProfile string          `json:"transformProfile,omitempty"`
+	Transforms       []TransformRule `json:"transforms,omitempty"`
+}
+
+// NamespaceOverride holds the labels and annotations set on a namespace
+// created by a restore, over those captured by the backup
+type NamespaceOverride struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// TransformRule changes the restored objects matching its kind, name glob and
+// label selector before they are sent to the API server. The merge patch is
+// applied first, then the JSON patch and the image registry rewrites.
+type TransformRule struct {
+	// Kind is the kind of the objects transformed, or "*" for every kind
+	Kind          ResourceKind `json:"kind"`
+	Name          string       `json:"name,omitempty"`
+	LabelSelector string       `json:"labelSelector,omitempty"`
+	// MergePatch is applied as a strategic merge patch to the built-in kinds,
+	// and as a JSON merge patch to the others
+	MergePatch map[string]interface{} `json:"mergePatch,omitempty"`
+	// JSONPatch holds RFC 6902 operations
+	JSONPatch []JSONPatchOperation `json:"jsonPatch,omitempty"`
+	// ImageRegistries maps the registry hosts of container images to new ones
+	ImageRegistries map[string]string `json:"imageRegistries,omitempty"`
+}
+
+// JSONPatchOperation is a single operation of a JSON patch. The value is kept
+// as given, so that a null value is not dropped.
+type JSONPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// TransformProfile is a named set of transform rules stored for reuse
+type TransformProfile struct {
+	Name      string          `json:"name"`
+	Rules     []TransformRule `json:"rules"`
+	UpdatedAt time.Time       `json:"updatedAt"`
 }
 
+// enums for the handling of the runs missed while the tool was down
+type MissedRunPolicy string
+
+const (
+	// MissedRunOnce runs a single backup for all the missed runs
+	MissedRunOnce MissedRunPolicy = "run-once"
+	MissedRunSkip MissedRunPolicy = "skip"
+)
+
+// Schedule backs up an application at the times of a cron expression, with
+// the options of a backup request
+type Schedule struct {
+	Name string `json:"name"`
+	BackupRequest
+	// Cron is a standard 5-field cron expression, or a descriptor such as
+	// @daily, evaluated in Timezone, UTC by default
+	Cron      string          `json:"cron"`
+	Timezone  string          `json:"timezone,omitempty"`
+	MissedRun MissedRunPolicy `json:"missedRunPolicy,omitempty"`
+	Paused    bool            `json:"paused"`
+	// The run state is maintained by the scheduler
+	NextRun       *time.Time `json:"nextRun,omitempty"`
+	LastRun       *time.Time `json:"lastRun,omitempty"`
+	LastBackupID  string     `json:"lastBackupId,omitempty"`
+	LastTaskID    string     `json:"lastTaskId,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	MissedRuns    int        `json:"missedRuns,omitempty"`
+	LastMissedRun *time.Time `json:"lastMissedRun,omitempty"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+// enums for the restore conflict policy
+type ConflictPolicy string
+
+const (
+	// ConflictSkip keeps the existing object
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictOverwrite replaces the existing object with the backed up one
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictFail stops the restore at the first existing object
+	ConflictFail ConflictPolicy = "fail"
+	// ConflictRename restores the object under its name with a suffix
+	ConflictRename ConflictPolicy = "rename"
+)
+
 type RestoreResponse struct {
-	Namespace string `json:"namespace"`
+	Namespace string `json:"namespace,omitempty"`
 	BackupID  string `json:"backupId"`
 	Message   string `json:"message"`
+	// Warnings are the caveats of a restore that went through, such as a
+	// backup restored without verification
+	Warnings []string `json:"warnings,omitempty"`
+	// NamespaceMapping is the target namespace of each source namespace
+	NamespaceMapping map[string]string `json:"namespaceMapping,omitempty"`
+	// OmittedKinds and ExcludedNames are what the backup intentionally left out
+	OmittedKinds  []ResourceKind `json:"omittedKinds,omitempty"`
+	ExcludedNames []string       `json:"excludedNames,omitempty"`
+	// SkippedOwnedObjects are the owned objects left to their controllers
+	SkippedOwnedObjects map[ResourceKind][]string `json:"skippedOwnedObjects,omitempty"`
+	// Transformed lists the objects changed by transform rules
+	Transformed map[ResourceKind][]string `json:"transformed,omitempty"`
+	// Created, Updated and Skipped list the names of the objects of each kind
+	// by outcome, Renamed maps the names of the renamed objects to their new name
+	Created map[ResourceKind][]string          `json:"created,omitempty"`
+	Updated map[ResourceKind][]string          `json:"updated,omitempty"`
+	Skipped map[ResourceKind][]string          `json:"skipped,omitempty"`
+	Renamed map[ResourceKind]map[string]string `json:"renamed,omitempty"`
+	// Plan is the outcome of a dry run
+	Plan *RestorePlan `json:"plan,omitempty"`
+	// Ready tells whether every restored workload became ready, with the state
+	// of each in Readiness. Both are only set with WaitForReady.
+	Ready     *bool               `json:"ready,omitempty"`
+	Readiness []WorkloadReadiness `json:"readiness,omitempty"`
+	// RolledBack lists the objects of each kind deleted by the rollback of an
+	// atomic restore, and RollbackErrors the objects that could not be deleted
+	RolledBack     map[ResourceKind][]string      `json:"rolledBack,omitempty"`
+	RollbackErrors map[ResourceKind][]ObjectError `json:"rollbackErrors,omitempty"`
+}
+
+// WorkloadReadiness is the state of a restored workload at the end of a restore
+type WorkloadReadiness struct {
+	Kind    ResourceKind `json:"kind"`
+	Name    string       `json:"name"`
+	Ready   bool         `json:"ready"`
+	Message string       `json:"message,omitempty"`
+}
+
+// RestorePlan lists what a restore would do to the objects of each kind
+type RestorePlan struct {
+	// New are the objects that do not exist yet
+	New map[ResourceKind][]string `json:"new,omitempty"`
+	// Changed are the existing objects that differ from the backup
+	Changed   map[ResourceKind][]ObjectDiff `json:"changed,omitempty"`
+	Unchanged map[ResourceKind][]string     `json:"unchanged,omitempty"`
+	// Rejected are the objects the API server would not accept
+	Rejected map[ResourceKind][]ObjectError `json:"rejected,omitempty"`
+}
+
+// ObjectDiff lists the fields of an existing object that the restore changes
+type ObjectDiff struct {
+	Name   string      `json:"name"`
+	Fields []FieldDiff `json:"fields"`
+}
+
+// FieldDiff is a field whose live value differs from the backed up one. A
+// missing value is a field present on one side only.
+type FieldDiff struct {
+	Path   string      `json:"path"`
+	Live   interface{} `json:"live,omitempty"`
+	Backup interface{} `json:"backup,omitempty"`
 }
 
 // enums for task status
 type TaskStatus string
 
 const (
+	Pending    TaskStatus = "pending"
 	Completed  TaskStatus = "completed"
 	Failed     TaskStatus = "failed"
 	InProgress TaskStatus = "in-progress"
 )
 
+// Task tracks an asynchronous backup and the progress of each resource kind
 type Task struct {
 	ID              string
+	AppID           string
+	BackupID        string
 	Status          TaskStatus
-	StartTime       timestamp.Timestamp
+	Message         string
+	StartTime       time.Time
+	EndTime         time.Time
 	TimeoutDuration time.Duration
+	Progress        map[ResourceKind]TaskStatus
+	Result          *BackupResponse
+	// Running stays true until the work of the task returns, which may be
+	// after the task timed out
+	Running bool
+}
+
+type TaskResponse struct {
+	ID        string                      `json:"id"`
+	AppID     string                      `json:"app"`
+	BackupID  string                      `json:"backupId"`
+	Status    TaskStatus                  `json:"status"`
+	Message   string                      `json:"message,omitempty"`
+	StartTime time.Time                   `json:"startTime"`
+	EndTime   *time.Time                  `json:"endTime,omitempty"`
+	Duration  string                      `json:"duration"`
+	Timeout   string                      `json:"timeout"`
+	Progress  map[ResourceKind]TaskStatus `json:"progress"`
+	Result    *BackupResponse             `json:"result,omitempty"`
 }
 
 // Resource kind
@@ -62,6 +557,7 @@ const (
 	PV             ResourceKind = "PV"
 	PVC            ResourceKind = "PVC"
 	ServiceAccount ResourceKind = "ServiceAccount"
+	Namespace      ResourceKind = "Namespace"
 )
 
 type BackupChan struct {
@@ -70,4 +566,4 @@ type BackupChan struct {
 	Kind      ResourceKind
 }
 
-var AllResources = []ResourceKind{Pod, Delpoyment, StatefulSet, Service, Secret, ConfigMap, ReplicaSet, PV, PVC, ServiceAccount}
+var AllResources = []ResourceKind{Pod, Delpoyment, StatefulSet, Service, Secret, ConfigMap, ReplicaSet, PV, PVC, ServiceAccount, Namespace}
@@ -2,7 +2,12 @@ package orchestratorClient
 
 import (
 	"github.com/arzzon/app-backup-restore/internal/constants"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
 	"os"
 	"strings"
@@ -28,13 +33,18 @@ import (
 //	return K8sClient
 //}
 
-func GetClientFromKubeconfig(kubeconfigPath string) (*kubernetes.Clientset, error) {
+// GetConfigFromKubeconfig loads the rest config from the kubeconfig file
+func GetConfigFromKubeconfig(kubeconfigPath string) (*rest.Config, error) {
 	// Load kubeconfig file
 	if kubeconfigPath == "" {
 		homeDir := os.Getenv("HOME")
 		kubeconfigPath = strings.Replace(constants.KUBECONFIG_PATH, "~", homeDir, 1)
 	}
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	return clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+}
+
+func GetClientFromKubeconfig(kubeconfigPath string) (*kubernetes.Clientset, error) {
+	config, err := GetConfigFromKubeconfig(kubeconfigPath)
 	if err != nil {
 		return nil, err
 	}
@@ -47,3 +57,39 @@ func GetClientFromKubeconfig(kubeconfigPath string) (*kubernetes.Clientset, erro
 
 	return clientset, nil
 }
+
+// GetClusterInfo returns the API server URL and the Kubernetes version of the cluster
+func GetClusterInfo(kubeconfigPath string) (string, string, error) {
+	config, err := GetConfigFromKubeconfig(kubeconfigPath)
+	if err != nil {
+		return "", "", err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", "", err
+	}
+	version, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		return config.Host, "", err
+	}
+	return config.Host, version.GitVersion, nil
+}
+
+// GetDynamicClientFromKubeconfig creates a dynamic client along with a RESTMapper
+// resolving kinds to resources through discovery
+func GetDynamicClientFromKubeconfig(kubeconfigPath string) (dynamic.Interface, meta.RESTMapper, error) {
+	config, err := GetConfigFromKubeconfig(kubeconfigPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(clientset.Discovery()))
+	return dynamicClient, mapper, nil
+}